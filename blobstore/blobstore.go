@@ -0,0 +1,170 @@
+// Package blobstore is the content-addressed store of rendered assets,
+// which the indexer writes and the web reads.
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/appengine/file"
+)
+
+const (
+	OBJECT_PREFIX = "blobs/"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Store is a content-addressed store of rendered assets.
+// The ref of a blob is the SHA256 of its data, so that putting the same data twice is harmless.
+type Store interface {
+	Put(ctx context.Context, data []byte, contentType string) (string, error)
+	Get(ctx context.Context, ref string) ([]byte, error)
+	Close() error
+}
+
+// Ref returns the ref of the data.
+func Ref(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// NewFromEnv returns the store of BLOB_STORE_BACKEND, which is GCS by default.
+// The GCS client is created with the context, so the store must not outlive it.
+func NewFromEnv(ctx context.Context) (Store, error) {
+	switch os.Getenv("BLOB_STORE_BACKEND") {
+	case "local":
+		return NewLocalStore(os.Getenv("LOCAL_BLOB_STORE_DIR")), nil
+	default:
+		bucket := os.Getenv("BLOB_STORE_BUCKET")
+		if bucket == "" {
+			var err error
+			bucket, err = file.DefaultBucketName(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return NewGCSStore(ctx, bucket)
+	}
+}
+
+// GCSStore stores blobs in the bucket by one client, which is reused by every Put and Get.
+type GCSStore struct {
+	Bucket string
+	client *storage.Client
+}
+
+func NewGCSStore(ctx context.Context, bucket string) (*GCSStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &GCSStore{
+		Bucket: bucket,
+		client: client,
+	}, nil
+}
+
+func (s *GCSStore) Put(ctx context.Context, data []byte, contentType string) (string, error) {
+	ref := Ref(data)
+	obj := s.client.Bucket(s.Bucket).Object(OBJECT_PREFIX + ref)
+	if _, err := obj.Attrs(ctx); err == nil {
+		return ref, nil
+	} else if err != storage.ErrObjectNotExist {
+		return "", err
+	}
+
+	w := obj.NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+func (s *GCSStore) Get(ctx context.Context, ref string) ([]byte, error) {
+	reader, err := s.client.Bucket(s.Bucket).Object(OBJECT_PREFIX + ref).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (s *GCSStore) Close() error {
+	return s.client.Close()
+}
+
+// LocalStore stores blobs in the filesystem, fanned out by the first 2 characters of the ref.
+type LocalStore struct {
+	Dir string
+}
+
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{
+		Dir: dir,
+	}
+}
+
+func (s *LocalStore) Put(ctx context.Context, data []byte, contentType string) (string, error) {
+	ref := Ref(data)
+	path := s.path(ref)
+	if _, err := os.Stat(path); err == nil {
+		return ref, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	// write to a temporary file first so that a crash doesn't leave a broken blob
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, ref string) ([]byte, error) {
+	if len(ref) < 2 {
+		return nil, ErrNotFound
+	}
+	data, err := ioutil.ReadFile(s.path(ref))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *LocalStore) Close() error {
+	return nil
+}
+
+func (s *LocalStore) path(ref string) string {
+	return filepath.Join(s.Dir, ref[:2], ref)
+}
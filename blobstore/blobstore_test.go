@@ -0,0 +1,46 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	store := NewLocalStore(dir)
+
+	ref, err := store.Put(ctx, []byte("<svg/>"), "image/svg+xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != Ref([]byte("<svg/>")) {
+		t.Errorf("ref must be the hash of the data: %s", ref)
+	}
+	again, err := store.Put(ctx, []byte("<svg/>"), "image/svg+xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != ref {
+		t.Errorf("the same data must have the same ref: %s, %s", ref, again)
+	}
+
+	data, err := store.Get(ctx, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "<svg/>" {
+		t.Errorf("unexpected data: %s", data)
+	}
+
+	if _, err := store.Get(ctx, Ref([]byte("missing"))); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, but got %v", err)
+	}
+}
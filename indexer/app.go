@@ -1,7 +1,9 @@
 package indexer
 
 import (
+	stdlog "log"
 	"net/http"
+	"os"
 
 	"github.com/go-chi/chi"
 )
@@ -9,11 +11,50 @@ import (
 func init() {
 	router := chi.NewRouter()
 
+	authTask := AuthTaskqueue
+	if secret := os.Getenv("TASK_SIGNING_SECRET"); secret != "" {
+		authTask = VerifyTaskSignature([]byte(secret))
+	}
+	authPush := func(next http.Handler) http.Handler {
+		// guarded by `login: admin` of app.yaml
+		return next
+	}
+	if audience := os.Getenv("PUBSUB_PUSH_AUDIENCE"); audience != "" {
+		serviceAccount := os.Getenv("PUBSUB_PUSH_SERVICE_ACCOUNT")
+		if serviceAccount == "" {
+			stdlog.Fatalf("PUBSUB_PUSH_SERVICE_ACCOUNT is required with PUBSUB_PUSH_AUDIENCE")
+		}
+		authPush = VerifyPubSubPush(audience, serviceAccount)
+	}
+
 	router.Route("/indexes", func(r chi.Router) {
-		r.Use(AuthTaskqueue)
+		r.Use(authTask)
 		r.Post("/", HandleIndexCreate)
 	})
-	router.Post("/_ah/push-handlers/gcs_notification", HandleGcsNotification)
+	router.Route("/imports", func(r chi.Router) {
+		r.Use(AuthApiToken)
+		r.Post("/", HandleImportCreate)
+		r.Get("/{importID:\\d+}", HandleImportGet)
+	})
+	router.With(AuthApiToken).Post("/previews", HandlePreview)
+	router.Get("/index_attempts", HandleIndexAttemptList)
+	router.Route("/scheduler", func(r chi.Router) {
+		r.With(AuthCron).Get("/tick", HandleSchedulerTick)
+		r.Get("/", HandleSchedulerStatus)
+	})
+	router.With(AuthInboundApp).Post("/umls/{umlID:\\d+}/renderings/{format}", HandleUmlRenderingCreate)
+	router.Get("/render_cache", HandleRenderCacheStatus)
+	router.Get("/svg_savings", HandleSvgSavings)
+	router.Get("/compat/{runID:\\d+}", HandleCompatReport)
+	router.Route("/migrations/{name}", func(r chi.Router) {
+		r.With(AuthApiToken).Post("/runs", HandleMigrationStart)
+		r.With(AuthApiToken).Get("/runs/{runID:\\d+}", HandleMigrationRunGet)
+		r.With(AuthApiToken).Get("/runs/{runID:\\d+}/results", HandleMigrationResultList)
+		r.With(authTask).Post("/batches", HandleMigrationBatch)
+	})
+	router.With(authPush).Post("/_ah/push-handlers/gcs_notification", HandleGcsNotification)
+
+	taskQueue = newTaskQueueFromEnv()
 
 	http.Handle("/", router)
 }
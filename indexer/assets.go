@@ -0,0 +1,319 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/yfuruyama/real-world-plantuml/blobstore"
+	"github.com/yfuruyama/real-world-plantuml/svgsanitizer"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// putUmlAssets stores the rendered outputs in the blob store, and sets their refs to the Uml.
+func putUmlAssets(ctx context.Context, blobs blobstore.Store, uml *Uml, svg, pngBase64, ascii string) error {
+	png, err := base64.StdEncoding.DecodeString(pngBase64)
+	if err != nil {
+		return err
+	}
+
+	if err := putUmlSvg(ctx, blobs, uml, []byte(svg)); err != nil {
+		return err
+	}
+	if uml.PngRef, err = blobs.Put(ctx, png, "image/png"); err != nil {
+		return err
+	}
+	if err := putUmlThumbnails(ctx, blobs, uml, png); err != nil {
+		return err
+	}
+	if uml.AsciiRef, err = blobs.Put(ctx, []byte(ascii), "text/plain; charset=utf-8"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// putUmlSvg stores the SVG for downloads, and the optimized one for pages.
+func putUmlSvg(ctx context.Context, blobs blobstore.Store, uml *Uml, svg []byte) error {
+	optimized, err := OptimizeSvg(svg)
+	if err != nil {
+		return err
+	}
+
+	if uml.SvgOriginalRef, err = blobs.Put(ctx, svg, "image/svg+xml"); err != nil {
+		return err
+	}
+	if uml.SvgRef, err = blobs.Put(ctx, optimized, "image/svg+xml"); err != nil {
+		return err
+	}
+	uml.SvgOriginalSize = len(svg)
+	uml.SvgSize = len(optimized)
+	return nil
+}
+
+// migrateUmlBlobs moves the inline outputs of a Uml to the blob store.
+func migrateUmlBlobs(ctx context.Context, run *MigrationRun, key *datastore.Key) (bool, error) {
+	var uml Uml
+	if err := datastore.Get(ctx, key, &uml); err != nil {
+		return false, err
+	}
+	if uml.SvgRef != "" {
+		return false, nil
+	}
+
+	blobs, err := blobstore.NewFromEnv(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer blobs.Close()
+	// inline ones are indexed before the sanitizer
+	svg, err := svgsanitizer.Sanitize([]byte(uml.Svg))
+	if err != nil {
+		return false, err
+	}
+	if err := putUmlAssets(ctx, blobs, &uml, string(svg), uml.PngBase64, uml.Ascii); err != nil {
+		return false, err
+	}
+	uml.Svg = ""
+	uml.PngBase64 = ""
+	uml.Ascii = ""
+
+	if _, err := datastore.Put(ctx, key, &uml); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rerenderUml renders the Uml again if it's rendered by another version of the renderer,
+// and reports whether the output is changed. If it fails, the current assets are kept.
+// It fails with a diagram error only, while the other errors of the renderer retry the batch.
+func rerenderUml(ctx context.Context, run *MigrationRun, key *datastore.Key) (bool, error) {
+	var uml Uml
+	if err := datastore.Get(ctx, key, &uml); err != nil {
+		return false, err
+	}
+
+	indexer, err := newIndexerFromEnv(ctx, "")
+	if err != nil {
+		return false, err
+	}
+	defer indexer.Close()
+	version, err := RendererVersion(ctx, indexer.Renderer)
+	if err != nil {
+		return false, &TemporaryMigrationError{err}
+	}
+	if uml.RendererVersion == version {
+		return false, nil
+	}
+
+	report := &SourceReport{Source: uml.Source}
+	if err := indexer.render(ctx, report); err != nil {
+		// only errors of the diagram are recorded, and the others such as an outage are retried
+		if !isDiagramError(err) {
+			return false, &TemporaryMigrationError{err}
+		}
+		return false, err
+	}
+
+	previousSvg, previousAscii, err := loadUmlOutputs(ctx, indexer.Blobs, &uml)
+	if err != nil {
+		return false, err
+	}
+	if err := putUmlAssets(ctx, indexer.Blobs, &uml, report.Svg, report.PngBase64, report.Ascii); err != nil {
+		return false, err
+	}
+	uml.Svg = ""
+	uml.PngBase64 = ""
+	uml.Ascii = ""
+	uml.RendererVersion = report.RendererVersion
+
+	if _, err := datastore.Put(ctx, key, &uml); err != nil {
+		return false, err
+	}
+	return umlOutputsChanged(previousSvg, previousAscii, []byte(report.Svg), []byte(report.Ascii)), nil
+}
+
+// loadUmlOutputs returns the SVG before the optimization and the ASCII of the Uml.
+func loadUmlOutputs(ctx context.Context, blobs blobstore.Store, uml *Uml) ([]byte, []byte, error) {
+	svg, ascii := []byte(uml.Svg), []byte(uml.Ascii)
+	svgRef := uml.SvgOriginalRef
+	if svgRef == "" {
+		svgRef = uml.SvgRef
+	}
+
+	var err error
+	if svgRef != "" {
+		if svg, err = blobs.Get(ctx, svgRef); err != nil {
+			return nil, nil, err
+		}
+	}
+	if uml.AsciiRef != "" {
+		if ascii, err = blobs.Get(ctx, uml.AsciiRef); err != nil {
+			return nil, nil, err
+		}
+	}
+	return svg, ascii, nil
+}
+
+// umlOutputsChanged compares the sanitized SVG and the ASCII, but not the PNG,
+// which embeds metadata such as the version of PlantUML. The new SVG is sanitized already,
+// and the previous one may be stored before the sanitizer.
+func umlOutputsChanged(previousSvg, previousAscii, svg, ascii []byte) bool {
+	sanitized, err := svgsanitizer.Sanitize(previousSvg)
+	if err != nil {
+		return true
+	}
+	return !bytes.Equal(sanitized, svg) || !bytes.Equal(previousAscii, ascii)
+}
+
+// sanitizeUmlSvg sanitizes the SVG of a Uml which is indexed before the sanitizer.
+func sanitizeUmlSvg(ctx context.Context, run *MigrationRun, key *datastore.Key) (bool, error) {
+	var uml Uml
+	if err := datastore.Get(ctx, key, &uml); err != nil {
+		return false, err
+	}
+
+	// the original is sanitized whenever it's stored
+	if uml.SvgOriginalRef != "" {
+		return false, nil
+	}
+
+	var blobs blobstore.Store
+	svg := []byte(uml.Svg)
+	if uml.SvgRef != "" {
+		var err error
+		if blobs, err = blobstore.NewFromEnv(ctx); err != nil {
+			return false, err
+		}
+		defer blobs.Close()
+		if svg, err = blobs.Get(ctx, uml.SvgRef); err != nil {
+			return false, err
+		}
+	}
+
+	sanitized, err := svgsanitizer.Sanitize(svg)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(sanitized, svg) {
+		return false, nil
+	}
+
+	if uml.SvgRef != "" {
+		if err := putUmlSvg(ctx, blobs, &uml, sanitized); err != nil {
+			return false, err
+		}
+	} else {
+		uml.Svg = string(sanitized)
+	}
+	if _, err := datastore.Put(ctx, key, &uml); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// optimizeUmlSvg optimizes the SVG of a Uml which is stored before the optimizer,
+// and keeps the current one for downloads. Sizes of every optimized Uml are added to the savings of the run.
+func optimizeUmlSvg(ctx context.Context, run *MigrationRun, key *datastore.Key) (bool, error) {
+	var uml Uml
+	if err := datastore.Get(ctx, key, &uml); err != nil {
+		return false, err
+	}
+	// inline ones are optimized by the "uml-blobs" migration
+	if uml.SvgRef == "" {
+		return false, nil
+	}
+	if uml.SvgOriginalRef != "" {
+		return false, addSvgSavings(run, &uml)
+	}
+
+	blobs, err := blobstore.NewFromEnv(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer blobs.Close()
+	svg, err := blobs.Get(ctx, uml.SvgRef)
+	if err != nil {
+		return false, err
+	}
+	// in case the "sanitize-svg" migration is not run yet
+	sanitized, err := svgsanitizer.Sanitize(svg)
+	if err != nil {
+		return false, err
+	}
+	if err := putUmlSvg(ctx, blobs, &uml, sanitized); err != nil {
+		return false, err
+	}
+
+	if _, err := datastore.Put(ctx, key, &uml); err != nil {
+		return false, err
+	}
+	return true, addSvgSavings(run, &uml)
+}
+
+// SvgSavings is the total size of SVGs before and after the optimization,
+// which is stored in Stats of the "optimize-svg" run.
+type SvgSavings struct {
+	Umls          int     `json:"umls"`
+	OriginalBytes int64   `json:"originalBytes"`
+	Bytes         int64   `json:"bytes"`
+	SavedBytes    int64   `json:"savedBytes"`
+	SavedRatio    float64 `json:"savedRatio"`
+	// RunId is the run of the "optimize-svg" migration which counted them
+	RunId     int64           `json:"runId"`
+	Status    MigrationStatus `json:"status"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// addSvgSavings adds sizes of the Uml to the savings of the run.
+// The run is saved at the end of each batch, so that a retried batch doesn't count twice.
+func addSvgSavings(run *MigrationRun, uml *Uml) error {
+	var savings SvgSavings
+	if len(run.Stats) > 0 {
+		if err := json.Unmarshal(run.Stats, &savings); err != nil {
+			return err
+		}
+	}
+	savings.Umls++
+	savings.OriginalBytes += int64(uml.SvgOriginalSize)
+	savings.Bytes += int64(uml.SvgSize)
+	savings.SavedBytes = savings.OriginalBytes - savings.Bytes
+	if savings.OriginalBytes > 0 {
+		savings.SavedRatio = float64(savings.SavedBytes) / float64(savings.OriginalBytes)
+	}
+
+	stats, err := json.Marshal(&savings)
+	if err != nil {
+		return err
+	}
+	run.Stats = stats
+	return nil
+}
+
+// FetchSvgSavings returns the savings counted by the latest run of the "optimize-svg" migration,
+// which are partial while it's running. It returns nil if the migration has never run.
+func FetchSvgSavings(ctx context.Context) (*SvgSavings, error) {
+	var runs []*MigrationRun
+	q := datastore.NewQuery("MigrationRun").Filter("name =", "optimize-svg").Order("-startedAt").Limit(1)
+	keys, err := q.GetAll(ctx, &runs)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, nil
+	}
+
+	run := runs[0]
+	savings := &SvgSavings{}
+	if len(run.Stats) > 0 {
+		if err := json.Unmarshal(run.Stats, savings); err != nil {
+			return nil, err
+		}
+	}
+	savings.RunId = keys[0].IntID()
+	savings.Status = run.Status
+	savings.UpdatedAt = run.UpdatedAt
+	return savings, nil
+}
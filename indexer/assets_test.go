@@ -0,0 +1,37 @@
+package indexer
+
+import (
+	"testing"
+
+	"github.com/yfuruyama/real-world-plantuml/svgsanitizer"
+)
+
+func TestUmlOutputsChanged(t *testing.T) {
+	svg := `<?xml version="1.0"?><svg><g><rect x="1"/><text x="2">Alice</text></g></svg>`
+	ascii := "Alice -> Bob"
+
+	tests := []struct {
+		previousSvg   string
+		previousAscii string
+		expected      bool
+	}{
+		{svg, ascii, false},
+		// comments which the renderer embeds are dropped by the sanitizer
+		{`<?xml version="1.0"?><!-- PlantUML version 1.2023.10 --><svg><g><rect x="1"/><text x="2">Alice</text></g></svg>`, ascii, false},
+		{`<?xml version="1.0"?><svg><g><rect x="3"/><text x="2">Alice</text></g></svg>`, ascii, true},
+		{svg, "Alice --> Bob", true},
+		{`<svg><g>`, ascii, true},
+	}
+
+	// the new SVG is sanitized by the indexer
+	sanitized, err := svgsanitizer.Sanitize([]byte(svg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		actual := umlOutputsChanged([]byte(tt.previousSvg), []byte(tt.previousAscii), sanitized, []byte(ascii))
+		if actual != tt.expected {
+			t.Errorf("not expected result: previousSvg=%s, got=%v, expected=%v", tt.previousSvg, actual, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	INDEX_ATTEMPTS_PER_PAGE = 100
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+type SourceOutcome string
+
+const (
+	SourceOutcomeSkippedShort  SourceOutcome = "skipped-short"
+	SourceOutcomeRejected      SourceOutcome = "rejected-policy"
+	SourceOutcomeDuplicate     SourceOutcome = "duplicate"
+	SourceOutcomeInvalidSyntax SourceOutcome = "invalid-syntax"
+	SourceOutcomeNoDiagram     SourceOutcome = "no-diagram"
+	SourceOutcomeRenderError   SourceOutcome = "render-error"
+	SourceOutcomeRendered      SourceOutcome = "rendered"
+	SourceOutcomeFailed        SourceOutcome = "failed"
+)
+
+// IndexAttempt is an audit log of an index creation for a GitHub URL.
+type IndexAttempt struct {
+	Url string `datastore:"url" json:"url"`
+	// Ref is the branch, tag or commit SHA in the URL
+	Ref        string               `datastore:"ref" json:"ref"`
+	StartedAt  time.Time            `datastore:"startedAt" json:"startedAt"`
+	DurationMs int64                `datastore:"durationMs,noindex" json:"durationMs"`
+	Error      string               `datastore:"error,noindex" json:"error,omitempty"`
+	Sources    []IndexAttemptSource `datastore:"sources" json:"sources"`
+}
+
+type IndexAttemptSource struct {
+	SourceSHA256 string        `datastore:"sourceSHA256" json:"sourceSHA256"`
+	Outcome      SourceOutcome `datastore:"outcome" json:"outcome"`
+	// UmlId is the created Uml for "rendered", or the existing one for "duplicate"
+	UmlId int64  `datastore:"umlId" json:"umlId,omitempty"`
+	Error string `datastore:"error,noindex" json:"error,omitempty"`
+}
+
+type IndexAttemptQuery struct {
+	Url     string
+	UmlId   int64
+	Outcome SourceOutcome
+	Cursor  string
+}
+
+func NewIndexAttempt(gitHubUrl string) *IndexAttempt {
+	attempt := &IndexAttempt{
+		Url:       gitHubUrl,
+		StartedAt: time.Now(),
+	}
+	if matched := gitHubUrlPattern.FindStringSubmatch(gitHubUrl); len(matched) == 5 {
+		attempt.Ref = matched[3]
+	}
+	return attempt
+}
+
+func (r *SourceReport) Outcome() SourceOutcome {
+	switch {
+	case len(r.Rejections) > 0 && r.Rejections[0].Rule == RuleMinSourceLength:
+		return SourceOutcomeSkippedShort
+	case len(r.Rejections) > 0:
+		return SourceOutcomeRejected
+	case r.DuplicateOf != 0:
+		return SourceOutcomeDuplicate
+	case r.SyntaxCheck == nil:
+		return SourceOutcomeFailed
+	case !r.SyntaxCheck.Valid:
+		return SourceOutcomeInvalidSyntax
+	case !r.HasValidDiagram:
+		return SourceOutcomeNoDiagram
+	case r.DiagramError != "":
+		return SourceOutcomeRenderError
+	case r.RenderError != "":
+		return SourceOutcomeFailed
+	default:
+		return SourceOutcomeRendered
+	}
+}
+
+func SaveIndexAttempt(ctx context.Context, attempt *IndexAttempt, err error) error {
+	attempt.DurationMs = int64(time.Since(attempt.StartedAt) / time.Millisecond)
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	key := datastore.NewIncompleteKey(ctx, "IndexAttempt", nil)
+	_, err = datastore.Put(ctx, key, attempt)
+	return err
+}
+
+// FetchIndexAttempts returns index attempts filtered by one of URL, Uml ID or outcome, newest first.
+func FetchIndexAttempts(ctx context.Context, query *IndexAttemptQuery) ([]*IndexAttempt, string, error) {
+	q := datastore.NewQuery("IndexAttempt").Order("-startedAt").Limit(INDEX_ATTEMPTS_PER_PAGE)
+	switch {
+	case query.Url != "":
+		q = q.Filter("url =", query.Url)
+	case query.UmlId != 0:
+		q = q.Filter("sources.umlId =", query.UmlId)
+	case query.Outcome != "":
+		q = q.Filter("sources.outcome =", query.Outcome)
+	}
+	if query.Cursor != "" {
+		decoded, err := datastore.DecodeCursor(query.Cursor)
+		if err != nil {
+			return nil, "", errInvalidCursor
+		}
+		q = q.Start(decoded)
+	}
+
+	var attempts []*IndexAttempt
+	iter := q.Run(ctx)
+	for {
+		var attempt IndexAttempt
+		_, err := iter.Next(&attempt)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		attempts = append(attempts, &attempt)
+	}
+
+	var nextCursor string
+	if len(attempts) == INDEX_ATTEMPTS_PER_PAGE {
+		cursor, err := iter.Cursor()
+		if err == nil {
+			nextCursor = cursor.String()
+		}
+	}
+	return attempts, nextCursor, nil
+}
@@ -0,0 +1,280 @@
+package indexer
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	GOOGLE_CERTS_URL       = "https://www.googleapis.com/oauth2/v3/certs"
+	GOOGLE_CERTS_CACHE_TTL = time.Hour
+	// GOOGLE_CERTS_MIN_REFETCH_INTERVAL limits refetches for unknown key IDs, which anyone can send
+	GOOGLE_CERTS_MIN_REFETCH_INTERVAL = time.Minute
+	JWT_CLOCK_SKEW                    = time.Minute
+	TASK_SIGNATURE_HEADER             = "X-Task-Signature"
+	TASK_SIGNATURE_ALGORITHM          = "hmac-sha256"
+	// TASK_SIGNATURE_MAX_AGE is how long a signed task is accepted after it becomes runnable,
+	// which covers retries of queue.yaml, so that a captured request can't be replayed later
+	TASK_SIGNATURE_MAX_AGE = time.Hour
+)
+
+var googleIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+var (
+	errInvalidJWT           = errors.New("invalid JWT")
+	errUnknownSigningKey    = errors.New("unknown signing key")
+	errNoServiceAccount     = errors.New("service account of push requests is not configured")
+	errInvalidTaskSignature = errors.New("invalid task signature")
+	errStaleTaskSignature   = errors.New("stale task signature")
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type JWTClaims struct {
+	Aud           string `json:"aud"`
+	Iss           string `json:"iss"`
+	Exp           int64  `json:"exp"`
+	Iat           int64  `json:"iat"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// Validate checks the claims of a Pub/Sub push request. The email of the service account is required,
+// because any service account can get a token for the audience.
+func (c *JWTClaims) Validate(audience, email string, now time.Time) error {
+	if email == "" {
+		return errNoServiceAccount
+	}
+	if c.Aud != audience {
+		return fmt.Errorf("audience mismatch: %s", c.Aud)
+	}
+	validIssuer := false
+	for _, iss := range googleIssuers {
+		if c.Iss == iss {
+			validIssuer = true
+		}
+	}
+	if !validIssuer {
+		return fmt.Errorf("issuer mismatch: %s", c.Iss)
+	}
+	if now.After(time.Unix(c.Exp, 0).Add(JWT_CLOCK_SKEW)) {
+		return fmt.Errorf("token expired at %d", c.Exp)
+	}
+	if now.Add(JWT_CLOCK_SKEW).Before(time.Unix(c.Iat, 0)) {
+		return fmt.Errorf("token issued in the future: %d", c.Iat)
+	}
+	if c.Email != email || !c.EmailVerified {
+		return fmt.Errorf("email mismatch: %s", c.Email)
+	}
+	return nil
+}
+
+// verifyJWT verifies RS256 signature of the token and returns its claims.
+func verifyJWT(token string, keys map[string]*rsa.PublicKey) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidJWT
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported algorithm: %s", header.Alg)
+	}
+	key, ok := keys[header.Kid]
+	if !ok {
+		return nil, errUnknownSigningKey
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature); err != nil {
+		return nil, err
+	}
+
+	var claims JWTClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errInvalidJWT
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errInvalidJWT
+	}
+	return nil
+}
+
+type googleCerts struct {
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+var googleCertsCache = &googleCerts{}
+
+// Keys returns Google's public keys for ID tokens, which are refetched when the cache is expired.
+func (g *googleCerts) Keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.keys != nil && time.Since(g.fetchedAt) < GOOGLE_CERTS_CACHE_TTL {
+		return g.keys, nil
+	}
+	return g.fetch(ctx)
+}
+
+// Refetch fetches keys again for an unknown key ID, such as after Google rotates keys.
+// The cached keys are returned if they are fetched recently.
+func (g *googleCerts) Refetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.keys != nil && time.Since(g.fetchedAt) < GOOGLE_CERTS_MIN_REFETCH_INTERVAL {
+		return g.keys, nil
+	}
+	return g.fetch(ctx)
+}
+
+func (g *googleCerts) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	client := urlfetch.Client(ctx)
+	resp, err := client.Get(GOOGLE_CERTS_URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch Google certs: status=%d", resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	g.keys = keys
+	g.fetchedAt = time.Now()
+	return keys, nil
+}
+
+// signTask returns the signature of a task request, which covers the time when it's runnable, method, path and payload.
+// The format is "t=<unix time>,hmac-sha256=<hex>".
+func signTask(secret []byte, signedAt time.Time, method, path string, payload []byte) string {
+	timestamp := signedAt.Unix()
+	return fmt.Sprintf("t=%d,%s=%s", timestamp, TASK_SIGNATURE_ALGORITHM, taskMac(secret, timestamp, method, path, payload))
+}
+
+func taskMac(secret []byte, timestamp int64, method, path string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d\n%s\n%s\n", timestamp, method, path)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyTaskSignature checks the signature, and rejects ones signed more than TASK_SIGNATURE_MAX_AGE ago.
+func verifyTaskSignature(secret []byte, method, path string, payload []byte, signature string, now time.Time) error {
+	var timestamp int64
+	var given string
+	for _, part := range strings.Split(signature, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return errInvalidTaskSignature
+		}
+		switch kv[0] {
+		case "t":
+			t, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return errInvalidTaskSignature
+			}
+			timestamp = t
+		case TASK_SIGNATURE_ALGORITHM:
+			given = kv[1]
+		}
+	}
+	if timestamp == 0 || given == "" {
+		return errInvalidTaskSignature
+	}
+
+	expected := taskMac(secret, timestamp, method, path, payload)
+	if !hmac.Equal([]byte(expected), []byte(given)) {
+		return errInvalidTaskSignature
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if now.Sub(signedAt) > TASK_SIGNATURE_MAX_AGE || signedAt.Sub(now) > JWT_CLOCK_SKEW {
+		return errStaleTaskSignature
+	}
+	return nil
+}
+
+// signingTaskQueue adds the signature header to every task.
+type signingTaskQueue struct {
+	TaskQueue
+	secret []byte
+}
+
+func (q *signingTaskQueue) Add(ctx context.Context, task *Task, queueName string) error {
+	signed := *task
+	signed.Header = make(http.Header)
+	for k, v := range task.Header {
+		signed.Header[k] = v
+	}
+	// signed at the time when it's runnable, because it's not dispatched until then
+	signedAt := time.Now().Add(task.Delay)
+	signed.Header.Set(TASK_SIGNATURE_HEADER, signTask(q.secret, signedAt, "POST", task.Path, task.Payload))
+	return q.TaskQueue.Add(ctx, &signed, queueName)
+}
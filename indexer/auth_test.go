@@ -0,0 +1,112 @@
+package indexer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]*rsa.PublicKey{"kid1": &key.PublicKey}
+
+	now := time.Now()
+	claims := JWTClaims{
+		Aud:           "https://indexer.example.com/_ah/push-handlers/gcs_notification",
+		Iss:           "https://accounts.google.com",
+		Exp:           now.Add(time.Hour).Unix(),
+		Iat:           now.Unix(),
+		Email:         "pubsub@example.iam.gserviceaccount.com",
+		EmailVerified: true,
+	}
+	token := signTestJWT(t, key, "kid1", &claims)
+
+	got, err := verifyJWT(token, keys)
+	if err != nil {
+		t.Fatalf("valid token is rejected: %s", err)
+	}
+	if err := got.Validate(claims.Aud, claims.Email, now); err != nil {
+		t.Errorf("valid claims are rejected: %s", err)
+	}
+	if err := got.Validate("https://other.example.com/", claims.Email, now); err == nil {
+		t.Errorf("audience mismatch should be rejected")
+	}
+	if err := got.Validate(claims.Aud, "", now); err != errNoServiceAccount {
+		t.Errorf("not expected error without service account: got=%v", err)
+	}
+	if err := got.Validate(claims.Aud, "other@example.com", now); err == nil {
+		t.Errorf("email mismatch should be rejected")
+	}
+	if err := got.Validate(claims.Aud, claims.Email, now.Add(2*time.Hour)); err == nil {
+		t.Errorf("expired token should be rejected")
+	}
+
+	if _, err := verifyJWT(signTestJWT(t, key, "kid2", &claims), keys); err != errUnknownSigningKey {
+		t.Errorf("unknown key should be rejected: err=%v", err)
+	}
+
+	tampered := *got
+	tampered.Aud = "https://other.example.com/"
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(&tampered)
+	if _, err := verifyJWT(parts[0]+"."+base64.RawURLEncoding.EncodeToString(payload)+"."+parts[2], keys); err == nil {
+		t.Errorf("tampered token should be rejected")
+	}
+}
+
+func TestVerifyTaskSignature(t *testing.T) {
+	secret := []byte("secret")
+	payload := []byte(`{"url":"https://github.com/foo/bar/blob/master/README.md"}`)
+	now := time.Unix(1500000000, 0)
+	signature := signTask(secret, now, "POST", "/indexes", payload)
+
+	var tests = []struct {
+		secret    []byte
+		path      string
+		payload   []byte
+		signature string
+		now       time.Time
+		expected  error
+	}{
+		{secret, "/indexes", payload, signature, now, nil},
+		{secret, "/indexes", payload, signature, now.Add(TASK_SIGNATURE_MAX_AGE), nil},
+		{[]byte("other"), "/indexes", payload, signature, now, errInvalidTaskSignature},
+		{secret, "/migrations", payload, signature, now, errInvalidTaskSignature},
+		{secret, "/indexes", []byte(`{}`), signature, now, errInvalidTaskSignature},
+		{secret, "/indexes", payload, "", now, errInvalidTaskSignature},
+		{secret, "/indexes", payload, "hmac-sha256=" + strings.SplitN(signature, "=", 3)[2], now, errInvalidTaskSignature},
+		// the timestamp is signed
+		{secret, "/indexes", payload, strings.Replace(signature, "t=1500000000", "t=1500003600", 1), now.Add(time.Hour), errInvalidTaskSignature},
+		// replayed later
+		{secret, "/indexes", payload, signature, now.Add(TASK_SIGNATURE_MAX_AGE + time.Second), errStaleTaskSignature},
+		{secret, "/indexes", payload, signature, now.Add(-JWT_CLOCK_SKEW - time.Second), errStaleTaskSignature},
+	}
+
+	for i, test := range tests {
+		got := verifyTaskSignature(test.secret, "POST", test.path, test.payload, test.signature, test.now)
+		if got != test.expected {
+			t.Errorf("not expected error: i=%d, got=%v, expected=%v", i, got, test.expected)
+		}
+	}
+}
+
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims *JWTClaims) string {
+	header, _ := json.Marshal(&jwtHeader{Alg: "RS256", Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
@@ -0,0 +1,106 @@
+package indexer
+
+import (
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// rendererBreaker is shared by the handlers and the scheduler tick.
+// The state is kept in memory because the indexer runs in a single instance.
+var rendererBreaker = NewCircuitBreaker(5, time.Minute)
+
+// CircuitBreaker opens after consecutive failures, and stays open during the cooldown.
+// After the cooldown it's half-open, where only one probe is allowed at a time.
+// A failure of the probe opens it again and a success closes it.
+type CircuitBreaker struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	// probing is true while the probe in half-open is running, which is given up after the cooldown
+	// in case it never reports the result
+	probing        bool
+	probeStartedAt time.Time
+}
+
+func NewCircuitBreaker(failureThreshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: failureThreshold,
+		Cooldown:         cooldown,
+	}
+}
+
+func (b *CircuitBreaker) State(now time.Time) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state(now)
+}
+
+func (b *CircuitBreaker) state(now time.Time) BreakerState {
+	if b.failures < b.FailureThreshold {
+		return BreakerClosed
+	}
+	if now.Sub(b.openedAt) < b.Cooldown {
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// Allow reports whether a request can be sent to the renderer. In half-open, it's allowed only as the probe,
+// so the caller must report the result by RecordSuccess, RecordFailure or Release.
+func (b *CircuitBreaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state(now) {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		return false
+	}
+	if b.probing && now.Sub(b.probeStartedAt) < b.Cooldown {
+		return false
+	}
+	b.probing = true
+	b.probeStartedAt = now
+	return true
+}
+
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) RecordFailure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures >= b.FailureThreshold {
+		b.openedAt = now
+	}
+	b.probing = false
+}
+
+// Release ends the probe without the result, such as when the request is canceled,
+// which tells nothing about the renderer.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
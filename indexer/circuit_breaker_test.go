@@ -0,0 +1,58 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker(3, time.Minute)
+
+	b.RecordFailure(now)
+	b.RecordFailure(now)
+	b.RecordSuccess()
+	b.RecordFailure(now)
+	b.RecordFailure(now)
+	if state := b.State(now); state != BreakerClosed {
+		t.Errorf("failures are not consecutive, but state is %s", state)
+	}
+
+	b.RecordFailure(now)
+	if b.Allow(now.Add(30 * time.Second)) {
+		t.Errorf("breaker must be open during the cooldown")
+	}
+
+	later := now.Add(time.Minute)
+	if state := b.State(later); state != BreakerHalfOpen {
+		t.Errorf("expected half-open after the cooldown, but got %s", state)
+	}
+	b.RecordFailure(later)
+	if state := b.State(later.Add(30 * time.Second)); state != BreakerOpen {
+		t.Errorf("a failure in half-open must open again, but got %s", state)
+	}
+
+	// only one probe in half-open
+	later = later.Add(time.Minute)
+	if !b.Allow(later) {
+		t.Errorf("the probe must be allowed in half-open")
+	}
+	if b.Allow(later) {
+		t.Errorf("only one probe must be allowed in half-open")
+	}
+	b.Release()
+	if !b.Allow(later) {
+		t.Errorf("a probe must be allowed after the released one")
+	}
+	if !b.Allow(later.Add(time.Minute)) {
+		t.Errorf("a probe which never reports must be given up after the cooldown")
+	}
+
+	b.RecordSuccess()
+	if state := b.State(later); state != BreakerClosed {
+		t.Errorf("a success must close, but got %s", state)
+	}
+	if !b.Allow(later) || !b.Allow(later) {
+		t.Errorf("closed breaker must allow every request")
+	}
+}
@@ -0,0 +1,421 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"unicode"
+
+	"google.golang.org/appengine/datastore"
+)
+
+type umlTokenKind int
+
+const (
+	tokenWord umlTokenKind = iota
+	tokenString
+	// tokenSymbol is a run of punctuations, such as arrows and braces
+	tokenSymbol
+	// tokenParen is a name in parentheses which is not a call, such as "(Use case)"
+	tokenParen
+	// tokenBracket is a name in brackets, such as "[Component]"
+	tokenBracket
+	// tokenColonName is a name in colons, such as ":Actor:"
+	tokenColonName
+	// tokenAction is an action of activity diagrams, such as ":do something;"
+	tokenAction
+)
+
+type umlToken struct {
+	Kind umlTokenKind
+	Text string
+}
+
+// umlStatement is the tokens of a line. Comments, labels after ":" and the texts of notes are dropped.
+type umlStatement struct {
+	Line     string
+	Tokens   []umlToken
+	HasLabel bool
+}
+
+// keyword is the first word in lower case, which decides what the statement is in most cases.
+func (s *umlStatement) keyword() string {
+	if len(s.Tokens) == 0 || s.Tokens[0].Kind != tokenWord {
+		return ""
+	}
+	return strings.ToLower(s.Tokens[0].Text)
+}
+
+// umlBlockEnds are the ends of multi-line blocks whose contents are free texts.
+var umlBlockEnds = map[string]string{
+	"note": "end note", "hnote": "end hnote", "rnote": "end rnote",
+	"legend": "endlegend", "title": "end title", "header": "endheader", "footer": "endfooter",
+}
+
+// tokenizeUml splits the source into statements of tokens.
+func tokenizeUml(source string) []umlStatement {
+	var statements []umlStatement
+	// the end of the block of texts, such as "end note"
+	blockEnd := ""
+	inComment := false
+	for _, line := range strings.Split(source, "\n") {
+		line = strings.TrimSpace(line)
+		if inComment {
+			i := strings.Index(line, "'/")
+			if i < 0 {
+				continue
+			}
+			inComment = false
+			line = strings.TrimSpace(line[i+2:])
+		}
+		if blockEnd != "" {
+			if isUmlBlockEnd(line, blockEnd) {
+				blockEnd = ""
+			}
+			continue
+		}
+		line, inComment = stripUmlComments(line)
+		if line == "" || strings.HasPrefix(line, "'") || strings.HasPrefix(line, "@start") || strings.HasPrefix(line, "@end") {
+			continue
+		}
+
+		statement := tokenizeUmlLine(line)
+		if len(statement.Tokens) == 0 {
+			continue
+		}
+		if end, ok := umlBlockEnds[statement.keyword()]; ok && isUmlBlockStart(statement) {
+			blockEnd = end
+		}
+		statements = append(statements, statement)
+	}
+	return statements
+}
+
+// stripUmlComments removes block comments in the line, and reports whether a block comment continues.
+func stripUmlComments(line string) (string, bool) {
+	for {
+		start := strings.Index(line, "/'")
+		if start < 0 {
+			return line, false
+		}
+		end := strings.Index(line[start+2:], "'/")
+		if end < 0 {
+			return strings.TrimSpace(line[:start]), true
+		}
+		line = strings.TrimSpace(line[:start] + " " + line[start+2+end+2:])
+	}
+}
+
+// isUmlBlockStart reports whether the statement opens a block, which doesn't have the text in the line
+// such as "note left of A" while "note left of A : text" is a single line.
+func isUmlBlockStart(statement umlStatement) bool {
+	if statement.HasLabel {
+		return false
+	}
+	switch statement.keyword() {
+	case "title", "header", "footer":
+		// "title text" is a single line
+		return len(statement.Tokens) == 1
+	}
+	for _, token := range statement.Tokens {
+		if token.Kind == tokenString {
+			// note "text" as N1
+			return false
+		}
+	}
+	return true
+}
+
+func isUmlBlockEnd(line, end string) bool {
+	fields := strings.Fields(strings.ToLower(line))
+	return strings.Join(fields, " ") == end || strings.Join(fields, "") == strings.Replace(end, " ", "", -1)
+}
+
+func isUmlWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '!' || r == '$'
+}
+
+func isUmlSymbolRune(r rune) bool {
+	return strings.ContainsRune("-.<>|{}*=+#^/\\~", r)
+}
+
+func tokenizeUmlLine(line string) umlStatement {
+	runes := []rune(line)
+	statement := umlStatement{Line: line}
+	add := func(kind umlTokenKind, text string) {
+		statement.Tokens = append(statement.Tokens, umlToken{kind, text})
+	}
+
+	if runes[0] == ':' {
+		// ":Actor:" or ":action;" of activity diagrams
+		rest := string(runes[1:])
+		if end := strings.IndexRune(rest, ':'); end >= 0 && !strings.ContainsAny(rest[:end], ";|") {
+			add(tokenColonName, rest[:end])
+			runes = []rune(rest[end+1:])
+		} else {
+			add(tokenAction, rest)
+			return statement
+		}
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == ':':
+			// a label, which is a free text
+			statement.HasLabel = true
+			return statement
+		case r == '"':
+			end := indexRune(runes, '"', i+1)
+			add(tokenString, string(runes[i+1:end]))
+			i = end + 1
+		case r == '(' && (i == 0 || !isUmlWordRune(runes[i-1])):
+			end := indexRune(runes, ')', i+1)
+			add(tokenParen, string(runes[i+1:end]))
+			i = end + 1
+		case r == '[' && (i == 0 || !isUmlSymbolRune(runes[i-1])):
+			end := indexRune(runes, ']', i+1)
+			add(tokenBracket, string(runes[i+1:end]))
+			i = end + 1
+		case isUmlWordRune(r) || r == '@':
+			start := i
+			for i++; i < len(runes) && isUmlWordRune(runes[i]); i++ {
+			}
+			add(tokenWord, string(runes[start:i]))
+		case isUmlSymbolRune(r):
+			start := i
+			for i++; i < len(runes); i++ {
+				if isUmlSymbolRune(runes[i]) {
+					continue
+				}
+				// heads of arrows such as "--o" and "x->", or styles such as "-[#red]->"
+				if (runes[i] == 'o' || runes[i] == 'x') && (i+1 == len(runes) || !isUmlWordRune(runes[i+1])) {
+					continue
+				}
+				if runes[i] == '[' {
+					// i is at the "]", or at the end if it's not closed
+					i = indexRune(runes, ']', i+1)
+					if i == len(runes) {
+						break
+					}
+					continue
+				}
+				break
+			}
+			add(tokenSymbol, string(runes[start:i]))
+		default:
+			add(tokenSymbol, string(r))
+			i++
+		}
+	}
+	return statement
+}
+
+// indexRune returns the index of r from the start, or the end of runes if it's not found.
+func indexRune(runes []rune, r rune, start int) int {
+	for i := start; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return len(runes)
+}
+
+// keywords of statements which are specific to diagram types
+var (
+	usecaseKeywords    = map[string]bool{"actor": true, "usecase": true}
+	componentKeywords  = map[string]bool{"component": true, "interface": true, "port": true, "portin": true, "portout": true}
+	deploymentKeywords = map[string]bool{
+		"node": true, "artifact": true, "cloud": true, "database": true, "storage": true, "folder": true,
+		"file": true, "frame": true, "stack": true, "queue": true, "agent": true, "card": true, "collections": true,
+	}
+	classKeywords  = map[string]bool{"class": true, "abstract": true, "interface": true, "enum": true, "annotation": true, "protocol": true, "struct": true}
+	objectKeywords = map[string]bool{"object": true, "map": true, "json": true}
+	timingKeywords = map[string]bool{"robust": true, "concise": true, "clock": true, "binary": true, "analog": true}
+	// archimatePrefixes are of the macros in the archimate standard library, such as Business_Actor(...)
+	archimatePrefixes = []string{"business_", "application_", "technology_", "physical_", "motivation_", "strategy_", "implementation_"}
+	// crowsFeet are the ends of relations in ER (IE) diagrams, such as "||--o{"
+	crowsFeet = []string{"|o", "o|", "||", "}o", "o{", "|{", "}|"}
+)
+
+// umlFeatures are counts of statements which are specific to diagram types.
+type umlFeatures struct {
+	Usecases    int
+	Components  int
+	Deployments int
+	Classes     int
+	Objects     int
+	Entities    int
+	CrowsFeet   int
+	Timings     int
+	Network     bool
+	Archimate   bool
+}
+
+func extractUmlFeatures(statements []umlStatement) *umlFeatures {
+	f := &umlFeatures{}
+	for _, statement := range statements {
+		keyword := statement.keyword()
+		switch {
+		case usecaseKeywords[keyword]:
+			f.Usecases++
+		case deploymentKeywords[keyword]:
+			f.Deployments++
+		case objectKeywords[keyword]:
+			f.Objects++
+		case timingKeywords[keyword]:
+			f.Timings++
+		case keyword == "entity":
+			f.Entities++
+		case keyword == "nwdiag":
+			f.Network = true
+		case keyword == "archimate":
+			f.Archimate = true
+		case keyword == "!include" || keyword == "!includeurl":
+			if strings.Contains(strings.ToLower(statement.Line), "archimate") {
+				f.Archimate = true
+			}
+		case len(statement.Tokens) > 1 && statement.Tokens[1].Text == "(" && hasAnyPrefix(keyword, archimatePrefixes):
+			f.Archimate = true
+		}
+		// "interface" is of both
+		if componentKeywords[keyword] {
+			f.Components++
+		}
+		if classKeywords[keyword] {
+			f.Classes++
+		}
+
+		for _, token := range statement.Tokens {
+			switch token.Kind {
+			case tokenParen:
+				if strings.TrimSpace(token.Text) == "" {
+					// "()" is an interface of component diagrams
+					f.Components++
+				} else {
+					f.Usecases++
+				}
+			case tokenColonName:
+				f.Usecases++
+			case tokenBracket:
+				f.Components++
+			case tokenSymbol:
+				for _, foot := range crowsFeet {
+					if strings.Contains(token.Text, foot) {
+						f.CrowsFeet++
+						break
+					}
+				}
+			}
+		}
+	}
+	return f
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyDiagram decides the type of the diagram from the type given by the syntax checker,
+// which doesn't tell some types such as usecase and component, and the statements of the source.
+func classifyDiagram(source string, checkedType string) DiagramType {
+	f := extractUmlFeatures(tokenizeUml(source))
+
+	// they are checked as other types, such as DESCRIPTION for archimate
+	if f.Network {
+		return TypeNetwork
+	}
+	if f.Archimate {
+		return TypeArchimate
+	}
+
+	switch checkedType {
+	case "SEQUENCE":
+		return TypeSequence
+	case "ACTIVITY":
+		return TypeActivity
+	case "STATE":
+		return TypeState
+	case "TIMING":
+		return TypeTiming
+	case "NWDIAG":
+		return TypeNetwork
+	case "OBJECT":
+		return TypeObject
+	case "CLASS":
+		switch {
+		case f.Entities > f.Classes, f.Entities > 0 && f.CrowsFeet > 0:
+			return TypeER
+		case f.Objects > f.Classes:
+			return TypeObject
+		default:
+			return TypeClass
+		}
+	case "DESCRIPTION":
+		switch {
+		case f.Deployments > 0 && f.Deployments >= f.Components && f.Deployments >= f.Usecases:
+			return TypeDeployment
+		case f.Usecases > f.Components:
+			return TypeUsecase
+		default:
+			return TypeComponent
+		}
+	default:
+		return TypeUnknwon
+	}
+}
+
+// reclassifyUml classifies the Uml again with the current classifier, which is run when it recognizes more types.
+func reclassifyUml(ctx context.Context, run *MigrationRun, key *datastore.Key) (bool, error) {
+	return reclassify(ctx, key, false)
+}
+
+// reclassifyUnknownUml is reclassifyUml only for TypeUnknwon, which is checked again
+// because the filter of the migration may see a stale index.
+func reclassifyUnknownUml(ctx context.Context, run *MigrationRun, key *datastore.Key) (bool, error) {
+	return reclassify(ctx, key, true)
+}
+
+func reclassify(ctx context.Context, key *datastore.Key, onlyUnknown bool) (bool, error) {
+	var uml Uml
+	if err := datastore.Get(ctx, key, &uml); err != nil {
+		return false, err
+	}
+	if onlyUnknown && uml.DiagramType != TypeUnknwon {
+		return false, nil
+	}
+
+	// Umls indexed before SyntaxDiagramType are checked again, and it's backfilled
+	syntaxType := uml.SyntaxDiagramType
+	if syntaxType == "" {
+		syntaxChecker := NewSyntaxChecker(ctx, os.Getenv("SYNTAX_CHECKER_BASE_URL"))
+		result, err := syntaxChecker.CheckSyntax(uml.Source)
+		if err != nil {
+			return false, err
+		}
+		if !result.HasValidDiagram() {
+			// the type is kept, because it may be a regression of the syntax checker
+			return false, errors.New("no valid diagram by the syntax checker")
+		}
+		syntaxType = result.DiagramType
+	}
+
+	typ := classifyDiagram(uml.Source, syntaxType)
+	if typ == uml.DiagramType && syntaxType == uml.SyntaxDiagramType {
+		return false, nil
+	}
+	uml.DiagramType = typ
+	uml.SyntaxDiagramType = syntaxType
+	if _, err := datastore.Put(ctx, key, &uml); err != nil {
+		return false, err
+	}
+	return true, nil
+}
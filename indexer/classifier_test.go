@@ -0,0 +1,104 @@
+package indexer
+
+import (
+	"testing"
+)
+
+func TestTokenizeUml(t *testing.T) {
+	source := `@startuml
+' actor in a comment
+/' usecase
+   in a block comment '/
+note left of A
+  actor in a note
+end note
+A -> B : actor in a label
+:User: --> (Login)
+[App] ..> [Db]
+@enduml`
+
+	statements := tokenizeUml(source)
+	if len(statements) != 4 {
+		t.Fatalf("not expected statements: got=%#v", statements)
+	}
+	if statements[0].keyword() != "note" {
+		t.Errorf("not expected keyword: got=%s", statements[0].keyword())
+	}
+	if !statements[1].HasLabel || len(statements[1].Tokens) != 3 {
+		t.Errorf("label should be dropped: got=%#v", statements[1])
+	}
+
+	expected := []umlToken{{tokenColonName, "User"}, {tokenSymbol, "-->"}, {tokenParen, "Login"}}
+	if !isSameTokens(statements[2].Tokens, expected) {
+		t.Errorf("not expected tokens: got=%#v, expected=%#v", statements[2].Tokens, expected)
+	}
+	expected = []umlToken{{tokenBracket, "App"}, {tokenSymbol, "..>"}, {tokenBracket, "Db"}}
+	if !isSameTokens(statements[3].Tokens, expected) {
+		t.Errorf("not expected tokens: got=%#v, expected=%#v", statements[3].Tokens, expected)
+	}
+
+	// every prefix, so that unclosed brackets, parentheses and strings are at the end of the line
+	for _, line := range []string{`A -[#red]-> (B) : "label"`, "A -[#red", "A -[", "A --[#red,dashed"} {
+		runes := []rune(line)
+		for i := 1; i <= len(runes); i++ {
+			statement := tokenizeUmlLine(string(runes[:i]))
+			for _, token := range statement.Tokens {
+				if len([]rune(token.Text)) > i {
+					t.Errorf("token is longer than the line: line=%q, token=%q", string(runes[:i]), token.Text)
+				}
+			}
+		}
+	}
+
+	statement := tokenizeUmlLine("A -[#red")
+	expected = []umlToken{{tokenWord, "A"}, {tokenSymbol, "-[#red"}}
+	if !isSameTokens(statement.Tokens, expected) {
+		t.Errorf("not expected tokens: got=%#v, expected=%#v", statement.Tokens, expected)
+	}
+}
+
+func TestClassifyDiagram(t *testing.T) {
+	var tests = []struct {
+		source      string
+		checkedType string
+		expected    DiagramType
+	}{
+		{"@startuml\nAlice -> Bob\n@enduml", "SEQUENCE", TypeSequence},
+		{"@startuml\nactor User\nUser --> (Login)\n@enduml", "DESCRIPTION", TypeUsecase},
+		{"@startuml\n:User: --> (Login)\n@enduml", "DESCRIPTION", TypeUsecase},
+		// words which contain "actor" are not actors
+		{"@startuml\n[Reactor] --> [Dispatcher] : actor\n' actor\n@enduml", "DESCRIPTION", TypeComponent},
+		{"@startuml\ncomponent App\n() HTTP - App\n@enduml", "DESCRIPTION", TypeComponent},
+		{"@startuml\nnode Server {\n  artifact app.war\n}\ndatabase Db\nServer --> Db\n@enduml", "DESCRIPTION", TypeDeployment},
+		{"@startuml\nclass Foo\nclass Bar\nFoo --> Bar\n@enduml", "CLASS", TypeClass},
+		{"@startuml\nobject user\nobject group\nuser --> group\n@enduml", "CLASS", TypeObject},
+		{"@startuml\nobject user\n@enduml", "OBJECT", TypeObject},
+		{"@startuml\nentity User {\n  id\n}\nentity Post\nUser ||--o{ Post\n@enduml", "CLASS", TypeER},
+		{"@startuml\nrobust \"Web\" as WB\n@0\nWB is Idle\n@enduml", "TIMING", TypeTiming},
+		{"@startuml\nnwdiag {\n  network dmz {\n    web01;\n  }\n}\n@enduml", "NWDIAG", TypeNetwork},
+		{"@startuml\n!include <archimate/Archimate>\nBusiness_Actor(a, \"Customer\")\n@enduml", "DESCRIPTION", TypeArchimate},
+		{"@startuml\narchimate #Business \"Customer\" <<business-actor>>\n@enduml", "DESCRIPTION", TypeArchimate},
+		{"@startuml\nstart\n:hello;\nstop\n@enduml", "ACTIVITY", TypeActivity},
+		{"@startuml\n[*] --> State1\n@enduml", "STATE", TypeState},
+		{"@startmindmap\n* root\n@endmindmap", "MINDMAP", TypeUnknwon},
+	}
+
+	for _, test := range tests {
+		got := classifyDiagram(test.source, test.checkedType)
+		if got != test.expected {
+			t.Errorf("not expected type: source=%q, got=%s, expected=%s", test.source, got, test.expected)
+		}
+	}
+}
+
+func isSameTokens(got []umlToken, expected []umlToken) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,302 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	COMPAT_RESULTS_PER_PAGE = 50
+)
+
+var errInvalidCompatParams = errors.New("compat needs two or more named endpoints")
+
+// CompatEndpoint is a renderer to be compared, such as plantuml-server of a version.
+type CompatEndpoint struct {
+	Name     string `json:"name"`
+	Backend  string `json:"backend"`
+	Location string `json:"location"`
+}
+
+// CompatParams are the params of the "compat" migration.
+// The first endpoint is the baseline which the others are compared with.
+type CompatParams struct {
+	Endpoints []CompatEndpoint `json:"endpoints"`
+}
+
+type CompatStatus string
+
+const (
+	CompatSame    CompatStatus = "same"
+	CompatFixed   CompatStatus = "fixed"
+	CompatChanged CompatStatus = "changed"
+	CompatBroken  CompatStatus = "broken"
+	CompatError   CompatStatus = "error"
+)
+
+// compatStatusOrder is from the worst, which decides the status of a diagram.
+var compatStatusOrder = []CompatStatus{CompatBroken, CompatChanged, CompatError, CompatFixed, CompatSame}
+
+type CompatEndpointResult struct {
+	Name     string       `datastore:"name,noindex"`
+	Valid    bool         `datastore:"valid,noindex"`
+	Error    string       `datastore:"error,noindex"`
+	Elements int          `datastore:"elements,noindex"`
+	Hash     string       `datastore:"hash,noindex"`
+	Status   CompatStatus `datastore:"status,noindex"`
+}
+
+// CompatResult is the comparison of a diagram, whose parent is the MigrationRun.
+type CompatResult struct {
+	UmlId     int64                  `datastore:"umlId"`
+	GitHubUrl string                 `datastore:"gitHubUrl,noindex"`
+	Status    CompatStatus           `datastore:"status"`
+	Endpoints []CompatEndpointResult `datastore:"endpoints"`
+	// Statuses are "{endpoint}:{status}" to count by endpoint
+	Statuses []string `datastore:"statuses"`
+}
+
+// CompatReport is the matrix of counts by endpoint and status.
+type CompatReport struct {
+	Run        *MigrationRun
+	Endpoints  []CompatEndpoint
+	Statuses   []CompatStatus
+	Counts     map[string]map[CompatStatus]int
+	Status     CompatStatus
+	Results    []*CompatResult
+	NextCursor string
+}
+
+func validateCompatParams(data []byte) error {
+	_, err := parseCompatParams(data)
+	return err
+}
+
+func parseCompatParams(data []byte) (*CompatParams, error) {
+	var params CompatParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, err
+	}
+	if len(params.Endpoints) < 2 {
+		return nil, errInvalidCompatParams
+	}
+	for _, endpoint := range params.Endpoints {
+		if endpoint.Name == "" {
+			return nil, errInvalidCompatParams
+		}
+	}
+	return &params, nil
+}
+
+// svgStructure returns the hash of the element tree and texts of the SVG, and the number of elements.
+// Attributes such as coordinates are ignored, because they change by font metrics or layout tweaks.
+func svgStructure(svg []byte) (string, int, error) {
+	var buf bytes.Buffer
+	elements := 0
+	decoder := xml.NewDecoder(bytes.NewReader(svg))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			elements++
+			fmt.Fprintf(&buf, "<%s>", t.Name.Local)
+		case xml.EndElement:
+			fmt.Fprintf(&buf, "</%s>", t.Name.Local)
+		case xml.CharData:
+			if text := strings.TrimSpace(string(t)); text != "" {
+				fmt.Fprintf(&buf, "%q", text)
+			}
+		}
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(hash[:]), elements, nil
+}
+
+// compatStatus compares the result with the baseline.
+func compatStatus(baseline, result *CompatEndpointResult) CompatStatus {
+	switch {
+	case baseline.Status == CompatError || result.Status == CompatError:
+		return CompatError
+	case baseline.Valid && !result.Valid:
+		return CompatBroken
+	case !baseline.Valid && result.Valid:
+		return CompatFixed
+	case baseline.Hash != result.Hash:
+		return CompatChanged
+	default:
+		return CompatSame
+	}
+}
+
+func worstCompatStatus(results []CompatEndpointResult) CompatStatus {
+	for _, status := range compatStatusOrder {
+		for _, result := range results {
+			if result.Status == status {
+				return status
+			}
+		}
+	}
+	return CompatSame
+}
+
+func renderCompatEndpoint(ctx context.Context, endpoint CompatEndpoint, source string) CompatEndpointResult {
+	result := CompatEndpointResult{Name: endpoint.Name}
+	renderer, err := NewRenderer(endpoint.Backend, endpoint.Location, "")
+	if err != nil {
+		result.Status = CompatError
+		result.Error = err.Error()
+		return result
+	}
+
+	svg, err := renderWithRetry(ctx, renderer, source, FormatSvg)
+	if isDiagramError(err) {
+		result.Error = err.(*RenderError).Message
+		return result
+	}
+	if err != nil {
+		result.Status = CompatError
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Hash, result.Elements, err = svgStructure(svg)
+	if err != nil {
+		result.Status = CompatError
+		result.Error = fmt.Sprintf("invalid svg: %s", err)
+		return result
+	}
+	result.Valid = true
+	return result
+}
+
+// compareUmlRenderings renders the Uml with every endpoint of the run,
+// and reports whether the diagram breaks or changes in any of them.
+func compareUmlRenderings(ctx context.Context, run *MigrationRun, key *datastore.Key) (bool, error) {
+	params, err := parseCompatParams(run.Params)
+	if err != nil {
+		return false, err
+	}
+
+	var uml Uml
+	if err := datastore.Get(ctx, key, &uml); err != nil {
+		return false, err
+	}
+
+	results := make([]CompatEndpointResult, len(params.Endpoints))
+	for i, endpoint := range params.Endpoints {
+		results[i] = renderCompatEndpoint(ctx, endpoint, uml.Source)
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i].Status == "" {
+			results[i].Status = compatStatus(&results[0], &results[i])
+		}
+	}
+	// the baseline is the same as itself unless it fails
+	if results[0].Status == "" {
+		results[0].Status = CompatSame
+	}
+
+	statuses := make([]string, len(results))
+	var errs []string
+	for i, result := range results {
+		statuses[i] = fmt.Sprintf("%s:%s", result.Name, result.Status)
+		if result.Status == CompatError {
+			errs = append(errs, fmt.Sprintf("%s: %s", result.Name, result.Error))
+		}
+	}
+
+	compat := &CompatResult{
+		UmlId:     key.IntID(),
+		GitHubUrl: uml.GitHubUrl,
+		Status:    worstCompatStatus(results),
+		Endpoints: results,
+		Statuses:  statuses,
+	}
+	runKey := datastore.NewKey(ctx, "MigrationRun", "", run.Id, nil)
+	compatKey := datastore.NewKey(ctx, "CompatResult", "", key.IntID(), runKey)
+	if _, err := datastore.Put(ctx, compatKey, compat); err != nil {
+		return false, err
+	}
+	// failures are listed in the results of the run as well
+	if len(errs) > 0 {
+		return false, errors.New(strings.Join(errs, ", "))
+	}
+	return compat.Status != CompatSame, nil
+}
+
+// FetchCompatReport counts the results of the run by endpoint and status,
+// and lists the results of the status.
+func FetchCompatReport(ctx context.Context, runId int64, status CompatStatus, cursor string) (*CompatReport, error) {
+	run, err := FetchMigrationRun(ctx, runId)
+	if err != nil || run == nil {
+		return nil, err
+	}
+	params, err := parseCompatParams(run.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	runKey := datastore.NewKey(ctx, "MigrationRun", "", runId, nil)
+	report := &CompatReport{
+		Run:       run,
+		Endpoints: params.Endpoints,
+		Statuses:  compatStatusOrder,
+		Counts:    make(map[string]map[CompatStatus]int),
+		Status:    status,
+	}
+	for _, endpoint := range params.Endpoints {
+		counts := make(map[CompatStatus]int)
+		for _, s := range compatStatusOrder {
+			q := datastore.NewQuery("CompatResult").Ancestor(runKey).Filter("statuses =", fmt.Sprintf("%s:%s", endpoint.Name, s)).KeysOnly()
+			n, err := q.Count(ctx)
+			if err != nil {
+				return nil, err
+			}
+			counts[s] = n
+		}
+		report.Counts[endpoint.Name] = counts
+	}
+
+	q := datastore.NewQuery("CompatResult").Ancestor(runKey).Filter("status =", status).Limit(COMPAT_RESULTS_PER_PAGE)
+	if cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Start(decoded)
+	}
+	iter := q.Run(ctx)
+	for {
+		var result CompatResult
+		_, err := iter.Next(&result)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Results = append(report.Results, &result)
+	}
+	if len(report.Results) == COMPAT_RESULTS_PER_PAGE {
+		if c, err := iter.Cursor(); err == nil {
+			report.NextCursor = c.String()
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,74 @@
+package indexer
+
+import (
+	"testing"
+)
+
+func TestSvgStructure(t *testing.T) {
+	svg := `<?xml version="1.0"?><svg><g><rect x="1" y="2"/><text x="10">Alice</text></g></svg>`
+	moved := `<?xml version="1.0"?><svg><g><rect x="3" y="5"/><text x="12"> Alice </text></g></svg>`
+	renamed := `<?xml version="1.0"?><svg><g><rect x="1" y="2"/><text x="10">Bob</text></g></svg>`
+
+	hash, elements, err := svgStructure([]byte(svg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elements != 4 {
+		t.Errorf("expected 4 elements, but got %d", elements)
+	}
+
+	movedHash, _, _ := svgStructure([]byte(moved))
+	if movedHash != hash {
+		t.Errorf("coordinates must be ignored")
+	}
+	renamedHash, _, _ := svgStructure([]byte(renamed))
+	if renamedHash == hash {
+		t.Errorf("texts must be compared")
+	}
+
+	if _, _, err := svgStructure([]byte(`<svg><g></svg>`)); err == nil {
+		t.Errorf("expected an error for a broken svg")
+	}
+}
+
+func TestCompatStatus(t *testing.T) {
+	valid := &CompatEndpointResult{Valid: true, Hash: "a"}
+	tests := []struct {
+		baseline *CompatEndpointResult
+		result   *CompatEndpointResult
+		expected CompatStatus
+	}{
+		{valid, &CompatEndpointResult{Valid: true, Hash: "a"}, CompatSame},
+		{valid, &CompatEndpointResult{Valid: true, Hash: "b"}, CompatChanged},
+		{valid, &CompatEndpointResult{Valid: false}, CompatBroken},
+		{&CompatEndpointResult{Valid: false}, valid, CompatFixed},
+		{&CompatEndpointResult{Valid: false}, &CompatEndpointResult{Valid: false}, CompatSame},
+		{&CompatEndpointResult{Status: CompatError}, valid, CompatError},
+	}
+	for _, test := range tests {
+		if status := compatStatus(test.baseline, test.result); status != test.expected {
+			t.Errorf("expected %s for %+v and %+v, but got %s", test.expected, test.baseline, test.result, status)
+		}
+	}
+
+	results := []CompatEndpointResult{{Status: CompatSame}, {Status: CompatFixed}, {Status: CompatBroken}}
+	if status := worstCompatStatus(results); status != CompatBroken {
+		t.Errorf("expected broken, but got %s", status)
+	}
+}
+
+func TestParseCompatParams(t *testing.T) {
+	if _, err := parseCompatParams([]byte(`{"endpoints": [{"name": "a"}]}`)); err != errInvalidCompatParams {
+		t.Errorf("a single endpoint must be rejected, but got %v", err)
+	}
+	if _, err := parseCompatParams([]byte(`{"endpoints": [{"name": "a"}, {"backend": "jar"}]}`)); err != errInvalidCompatParams {
+		t.Errorf("an endpoint without name must be rejected, but got %v", err)
+	}
+	params, err := parseCompatParams([]byte(`{"endpoints": [{"name": "a"}, {"name": "b", "backend": "kroki", "location": "http://kroki"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Endpoints[1].Backend != "kroki" {
+		t.Errorf("unexpected endpoint: %+v", params.Endpoints[1])
+	}
+}
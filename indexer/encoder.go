@@ -0,0 +1,80 @@
+package indexer
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// plantUMLAlphabet is the base64 alphabet of PlantUML, which differs from both standard and URL encoding.
+const plantUMLAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-_"
+
+var errInvalidEncodedUml = errors.New("invalid encoded uml")
+
+// EncodeUml returns the ID of the source used in URLs of plantuml-server, such as /svg/{id}.
+// The ID decodes to the same source on plantuml-server, but it may differ from the one which
+// the server redirects to from POST /form, because the deflate output of Go differs from Java.
+func EncodeUml(source string) (string, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write([]byte(source)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return encodePlantUMLBase64(buf.Bytes()), nil
+}
+
+// DecodeUml returns the source of the ID.
+func DecodeUml(encoded string) (string, error) {
+	data, err := decodePlantUMLBase64(encoded)
+	if err != nil {
+		return "", err
+	}
+	source, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return "", errInvalidEncodedUml
+	}
+	return string(source), nil
+}
+
+// encodePlantUMLBase64 encodes every 3 bytes into 4 characters.
+// Like PlantUML, the last group is padded with zero bits instead of '='.
+func encodePlantUMLBase64(data []byte) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(data); i += 3 {
+		var b [3]byte
+		copy(b[:], data[i:])
+		buf.WriteByte(plantUMLAlphabet[b[0]>>2])
+		buf.WriteByte(plantUMLAlphabet[(b[0]&0x3)<<4|b[1]>>4])
+		buf.WriteByte(plantUMLAlphabet[(b[1]&0xf)<<2|b[2]>>6])
+		buf.WriteByte(plantUMLAlphabet[b[2]&0x3f])
+	}
+	return buf.String()
+}
+
+// decodePlantUMLBase64 may return trailing zero bytes of the padding, which the deflate reader ignores.
+func decodePlantUMLBase64(s string) ([]byte, error) {
+	data := make([]byte, 0, len(s)*3/4+3)
+	for i := 0; i < len(s); i += 4 {
+		var c [4]byte
+		for j := 0; j < 4; j++ {
+			if i+j >= len(s) {
+				break
+			}
+			idx := strings.IndexByte(plantUMLAlphabet, s[i+j])
+			if idx < 0 {
+				return nil, errInvalidEncodedUml
+			}
+			c[j] = byte(idx)
+		}
+		data = append(data, c[0]<<2|c[1]>>4, c[1]<<4|c[2]>>2, c[2]<<6|c[3])
+	}
+	return data, nil
+}
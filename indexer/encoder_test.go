@@ -0,0 +1,46 @@
+package indexer
+
+import (
+	"testing"
+)
+
+func TestDecodeUml(t *testing.T) {
+	// the example in the PlantUML documentation
+	source, err := DecodeUml("SyfFKj2rKt3CoKnELR1Io4ZDoSa70000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != "Bob -> Alice : hello" {
+		t.Errorf("unexpected source: %q", source)
+	}
+
+	if _, err := DecodeUml("Syf!"); err != errInvalidEncodedUml {
+		t.Errorf("expected errInvalidEncodedUml, but got %v", err)
+	}
+}
+
+func TestEncodeUml(t *testing.T) {
+	sources := []string{
+		"",
+		"a",
+		"ab",
+		"abc",
+		"@startuml\nBob -> Alice : こんにちは\n@enduml",
+	}
+	for _, source := range sources {
+		encoded, err := EncodeUml(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encoded)%4 != 0 {
+			t.Errorf("encoded length must be a multiple of 4: %q", encoded)
+		}
+		decoded, err := DecodeUml(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != source {
+			t.Errorf("expected %q, but got %q", source, decoded)
+		}
+	}
+}
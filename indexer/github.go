@@ -0,0 +1,64 @@
+package indexer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+)
+
+var errInvalidGitHubUrl = errors.New("invalid github url")
+
+var gitHubUrlPattern = regexp.MustCompile(`^https://github.com/([^/]+)/([^/]+)/blob/([^/]+)/(.+)$`)
+
+type GitHubContentResponse struct {
+	Path    string `json:"path"`
+	Sha     string `json:"sha"`
+	Content string `json:"content"`
+}
+
+// fetchGitHubContent returns the content of the file which the GitHub blob URL points to.
+func fetchGitHubContent(ctx context.Context, gitHubUrl string) (string, error) {
+	matched := gitHubUrlPattern.FindStringSubmatch(gitHubUrl)
+	if len(matched) != 5 {
+		return "", errInvalidGitHubUrl
+	}
+
+	owner := matched[1]
+	repo := matched[2]
+	hash := matched[3]
+	path := matched[4]
+
+	apiUrl := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s?ref=%s", owner, repo, path, hash)
+
+	token := os.Getenv("GITHUB_API_TOKEN")
+	req, _ := http.NewRequest("GET", apiUrl, nil)
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
+
+	client := urlfetch.Client(ctx)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request to GitHub: %s", err)
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	var ghcResp GitHubContentResponse
+	if err := decoder.Decode(&ghcResp); err != nil {
+		return "", fmt.Errorf("failed to parse response: %s", err)
+	}
+
+	log.Infof(ctx, "Get content response: %#v", ghcResp)
+	contentBytes, err := base64.StdEncoding.DecodeString(ghcResp.Content)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse GitHub content: %s", err)
+	}
+	return string(contentBytes), nil
+}
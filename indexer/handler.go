@@ -1,41 +1,77 @@
 package indexer
 
 import (
-	"bufio"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
+	"html/template"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"regexp"
+	"strconv"
 	"time"
 
+	"github.com/yfuruyama/real-world-plantuml/blobstore"
+
 	"cloud.google.com/go/storage"
+	"github.com/go-chi/chi"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/file"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/taskqueue"
-	"google.golang.org/appengine/urlfetch"
 )
 
 type IndexCreateRequestBody struct {
-	Url string `json:"url"`
+	Url      string         `json:"url"`
+	ImportId int64          `json:"importId,omitempty"`
+	Tags     []string       `json:"tags,omitempty"`
+	Priority ImportPriority `json:"priority,omitempty"`
+}
+
+type ImportCreateRequestBody struct {
+	Urls     []string       `json:"urls"`
+	Tags     []string       `json:"tags"`
+	Priority ImportPriority `json:"priority"`
+}
+
+type ImportCreateResponseBody struct {
+	Id     int64 `json:"id"`
+	Queued int   `json:"queued"`
+}
+
+type MigrationStartResponseBody struct {
+	Id int64 `json:"id"`
+}
+
+type MigrationResultListResponseBody struct {
+	Results    []*MigrationResult `json:"results"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+}
+
+type PreviewRequestBody struct {
+	Url  string `json:"url"`
+	Text string `json:"text"`
+	// Renderer overrides RENDERER_BACKEND to compare outputs between backends
+	Renderer string `json:"renderer"`
+}
+
+type PreviewResponseBody struct {
+	Sources []*SourceReport `json:"sources"`
 }
 
-type GitHubContentResponse struct {
-	Path    string `json:"path"`
-	Sha     string `json:"sha"`
-	Content string `json:"content"`
+type IndexAttemptListResponseBody struct {
+	Attempts   []*IndexAttempt `json:"attempts"`
+	NextCursor string          `json:"nextCursor,omitempty"`
 }
 
 type PubSubSubscription struct {
-	Message      PubSubMessage `json:message`
-	Subscription string        `json:subscription`
+	Message      PubSubMessage `json:"message"`
+	Subscription string        `json:"subscription"`
 }
 
 type PubSubMessage struct {
-	Attributes map[string]string `json:attributes`
-	MessageId  string            `json:messageId`
+	Attributes map[string]string `json:"attributes"`
+	MessageId  string            `json:"messageId"`
 }
 
 func HandleIndexCreate(w http.ResponseWriter, r *http.Request) {
@@ -51,67 +87,141 @@ func HandleIndexCreate(w http.ResponseWriter, r *http.Request) {
 
 	log.Infof(ctx, "url: %s", body.Url)
 
-	re := regexp.MustCompile(`^https://github.com/([^/]+)/([^/]+)/blob/([^/]+)/(.+)$`)
-	matched := re.FindStringSubmatch(body.Url)
-	if len(matched) != 5 {
-		log.Warningf(ctx, "invalid github url")
-		w.WriteHeader(http.StatusOK)
+	// the task is retried by the queue after the breaker's cooldown
+	if rendererBreaker.State(time.Now()) == BreakerOpen {
+		log.Warningf(ctx, "renderer circuit breaker is open")
+		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
-	owner := matched[1]
-	repo := matched[2]
-	hash := matched[3]
-	path := matched[4]
-
-	apiUrl := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s?ref=%s", owner, repo, path, hash)
-
-	token := os.Getenv("GITHUB_API_TOKEN")
-	req, _ := http.NewRequest("GET", apiUrl, nil)
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
+	attempt := NewIndexAttempt(body.Url)
+	outcome, indexErr := createIndexes(ctx, w, body, attempt)
+	if err := SaveIndexAttempt(ctx, attempt, indexErr); err != nil {
+		log.Errorf(ctx, "failed to save index attempt: %s", err)
+	}
+	if body.ImportId != 0 {
+		if err := RecordImportResult(ctx, body.ImportId, body.Url, outcome); err != nil {
+			log.Errorf(ctx, "failed to record import result: %s", err)
+		}
+	}
+}
 
-	client := urlfetch.Client(ctx)
-	resp, err := client.Do(req)
+// createIndexes writes the response and returns the outcome to be recorded for the import.
+// Outcomes of sources are added to the attempt.
+func createIndexes(ctx context.Context, w http.ResponseWriter, body IndexCreateRequestBody, attempt *IndexAttempt) (ImportOutcome, error) {
+	content, err := fetchGitHubContent(ctx, body.Url)
+	if err == errInvalidGitHubUrl {
+		log.Warningf(ctx, "invalid github url")
+		w.WriteHeader(http.StatusOK)
+		return OutcomeSkipped, err
+	}
 	if err != nil {
-		log.Criticalf(ctx, "Failed to request to GitHub: err=%s", err)
+		log.Criticalf(ctx, "%s", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return OutcomeFailed, err
 	}
-	defer resp.Body.Close()
 
-	decoder = json.NewDecoder(resp.Body)
-	var ghcResp GitHubContentResponse
-	if err := decoder.Decode(&ghcResp); err != nil {
-		log.Criticalf(ctx, "Failed to parse response: %s", err)
+	indexer, err := newIndexerFromEnv(ctx, "")
+	if err != nil {
+		log.Criticalf(ctx, "%s", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return OutcomeFailed, err
+	}
+	defer indexer.Close()
+	attempt.Sources, err = indexer.CreateIndexes(ctx, content, body.Url, body.Tags)
+	if err == errRendererUnavailable {
+		log.Warningf(ctx, "%s", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return OutcomeFailed, err
 	}
-
-	log.Infof(ctx, "Get content response: %#v", ghcResp)
-	contentBytes, err := base64.StdEncoding.DecodeString(ghcResp.Content)
 	if err != nil {
-		log.Criticalf(ctx, "Failed to parse GitHub content: err=%s", err)
+		log.Criticalf(ctx, "%s", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return OutcomeFailed, err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "ok")
+	return OutcomeProcessed, nil
+}
+
+func newIndexerFromEnv(ctx context.Context, rendererBackend string) (*Indexer, error) {
+	policy, err := LoadInclusionPolicy()
+	if err != nil {
+		return nil, err
 	}
-	content := string(contentBytes)
 
-	rendererBaseUrl := os.Getenv("RENDERER_BASE_URL")
-	renderer := NewRenderer(ctx, rendererBaseUrl)
+	renderer, err := NewRendererFromEnv(rendererBackend)
+	if err != nil {
+		return nil, err
+	}
 
 	syntaxCheckerBaseUrl := os.Getenv("SYNTAX_CHECKER_BASE_URL")
 	syntaxChecker := NewSyntaxChecker(ctx, syntaxCheckerBaseUrl)
 
-	indexer := NewIndexer(renderer, syntaxChecker)
-	err = indexer.CreateIndexes(ctx, content, body.Url)
+	blobs, err := blobstore.NewFromEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	indexer := NewIndexer(renderer, syntaxChecker, policy, blobs)
+	// the breaker and the bucket are of the configured backend, not the one compared in previews
+	if rendererBackend == "" {
+		indexer.Breaker = rendererBreaker
+		indexer.RateLimited = true
+	}
+	return indexer, nil
+}
+
+// HandlePreview runs the indexing pipeline for the URL or the raw text without writing anything.
+func HandlePreview(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	var body PreviewRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Warningf(ctx, "%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	text := body.Text
+	if body.Url != "" {
+		content, err := fetchGitHubContent(ctx, body.Url)
+		if err == errInvalidGitHubUrl {
+			log.Warningf(ctx, "invalid github url: %s", body.Url)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Criticalf(ctx, "%s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		text = content
+	}
+
+	indexer, err := newIndexerFromEnv(ctx, body.Renderer)
+	if err == errUnknownRendererBackend {
+		log.Warningf(ctx, "%s: %s", err, body.Renderer)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Criticalf(ctx, "%s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	defer indexer.Close()
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "ok")
+	reports, err := indexer.PreviewIndexes(ctx, text)
+	if err != nil {
+		log.Criticalf(ctx, "failed to preview indexes: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&PreviewResponseBody{Sources: reports})
 }
 
 func HandleGcsNotification(w http.ResponseWriter, r *http.Request) {
@@ -127,7 +237,7 @@ func HandleGcsNotification(w http.ResponseWriter, r *http.Request) {
 
 	log.Infof(ctx, "Received: %#v", sub)
 
-	// TODO: more sophisticated guard
+	// the sender is verified by the middleware, but the subscription may deliver other messages
 	if _, ok := sub.Message.Attributes["eventType"]; !ok {
 		log.Warningf(ctx, "Not GCS notification")
 		w.WriteHeader(http.StatusOK)
@@ -166,35 +276,330 @@ func HandleGcsNotification(w http.ResponseWriter, r *http.Request) {
 	}
 	defer reader.Close()
 
-	i := 0
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		line := scanner.Text()
-		log.Infof(ctx, "Read line: %s", line)
+	items, err := parseImportItems("text/plain", reader)
+	if err == errNoImportUrls {
+		// nothing to import, so the notification is not retried
+		log.Warningf(ctx, "no urls in object %v", objectId)
+		fmt.Fprintf(w, "ok")
+		return
+	}
+	if err != nil {
+		log.Criticalf(ctx, "failed to read object %v: %v", objectId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, item := range items {
+		// bulk crawls yield to manual submissions
+		item.Priority = PriorityLow
+	}
 
-		header := make(http.Header)
-		header.Set("Content-Type", "application/json")
+	importId, queued, err := CreateImport(ctx, OriginGcs, objectId, items)
+	if err != nil {
+		log.Criticalf(ctx, "failed to create import: id=%d, queued=%d, err=%s", importId, queued, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof(ctx, "Created import: id=%d, queued=%d", importId, queued)
 
-		body := &IndexCreateRequestBody{
-			Url: line,
-		}
-		bodyBytes, err := json.Marshal(body)
-		if err != nil {
-			log.Criticalf(ctx, "json marshal error: %s", err)
-			continue
-		}
+	fmt.Fprintf(w, "ok")
+}
 
-		task := &taskqueue.Task{
-			Path:    "/indexes",
-			Payload: bodyBytes,
-			Header:  header,
-			Method:  "POST",
-			Delay:   5 * time.Second * time.Duration(i),
-		}
-		taskqueue.Add(ctx, task, "index-create-queue")
+func HandleImportCreate(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	items, err := parseImportItems(r.Header.Get("Content-Type"), r.Body)
+	if err != nil {
+		log.Warningf(ctx, "%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	importId, queued, err := CreateImport(ctx, OriginApi, "", items)
+	if err != nil {
+		log.Criticalf(ctx, "failed to create import: id=%d, queued=%d, err=%s", importId, queued, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof(ctx, "Created import: id=%d, queued=%d", importId, queued)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&ImportCreateResponseBody{
+		Id:     importId,
+		Queued: queued,
+	})
+}
+
+func HandleImportGet(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	importId, _ := strconv.ParseInt(chi.URLParam(r, "importID"), 10, 64)
 
-		i++
+	status, err := FetchImportStatus(ctx, importId)
+	if err != nil {
+		log.Criticalf(ctx, "failed to fetch import status: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if status == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func HandleMigrationStart(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	name := chi.URLParam(r, "name")
+
+	// the body is optional params of the migration
+	params, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Warningf(ctx, "%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(params) > 0 && !json.Valid(params) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	runId, err := StartMigration(ctx, name, params)
+	if err == errUnknownMigration {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if _, ok := err.(*InvalidMigrationParamsError); ok {
+		log.Warningf(ctx, "%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Criticalf(ctx, "failed to start migration: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof(ctx, "Started migration: name=%s, run=%d", name, runId)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&MigrationStartResponseBody{Id: runId})
+}
+
+func HandleMigrationRunGet(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	runId, _ := strconv.ParseInt(chi.URLParam(r, "runID"), 10, 64)
+
+	run, err := FetchMigrationRun(ctx, runId)
+	if err != nil {
+		log.Criticalf(ctx, "failed to fetch migration run: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if run == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+func HandleMigrationResultList(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	runId, _ := strconv.ParseInt(chi.URLParam(r, "runID"), 10, 64)
+	queryParams := r.URL.Query()
+
+	cursor := queryParams.Get("cursor")
+	results, nextCursor, err := FetchMigrationResults(ctx, runId, MigrationOutcome(queryParams.Get("outcome")), cursor)
+	if err == errInvalidCursor {
+		log.Warningf(ctx, "%s: %s", err, cursor)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Criticalf(ctx, "failed to fetch migration results: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&MigrationResultListResponseBody{
+		Results:    results,
+		NextCursor: nextCursor,
+	})
+}
+
+func HandleMigrationBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	var body MigrationBatchRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Warningf(ctx, "%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := RunMigrationBatch(ctx, chi.URLParam(r, "name"), &body)
+	if _, ok := err.(*TemporaryMigrationError); ok {
+		log.Warningf(ctx, "%s", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Criticalf(ctx, "failed to run migration batch: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	fmt.Fprintf(w, "ok")
 }
+
+func HandleSchedulerTick(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	dispatched, err := RunSchedulerTick(ctx)
+	if err != nil {
+		log.Criticalf(ctx, "scheduler tick error: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof(ctx, "dispatched %d tasks", dispatched)
+
+	fmt.Fprintf(w, "ok")
+}
+
+func HandleSchedulerStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	status, err := FetchSchedulerStatus(ctx)
+	if err != nil {
+		log.Criticalf(ctx, "failed to fetch scheduler status: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func HandleCompatReport(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	runId, _ := strconv.ParseInt(chi.URLParam(r, "runID"), 10, 64)
+	queryParams := r.URL.Query()
+	status := CompatStatus(queryParams.Get("status"))
+	if status == "" {
+		status = CompatBroken
+	}
+
+	report, err := FetchCompatReport(ctx, runId, status, queryParams.Get("cursor"))
+	if err != nil {
+		log.Criticalf(ctx, "failed to fetch compat report: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/compat.html"))
+	if err := tmpl.Execute(w, report); err != nil {
+		log.Criticalf(ctx, "failed to render compat report: %s", err)
+	}
+}
+
+func HandleRenderCacheStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FetchRenderCacheStatus())
+}
+
+// HandleUmlRenderingCreate renders a format for downloads of the web, which isn't rendered at indexing.
+func HandleUmlRenderingCreate(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	umlId, _ := strconv.ParseInt(chi.URLParam(r, "umlID"), 10, 64)
+	format := RenderFormat(chi.URLParam(r, "format"))
+
+	indexer, err := newIndexerFromEnv(ctx, "")
+	if err != nil {
+		log.Criticalf(ctx, "%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer indexer.Close()
+
+	data, err := CreateUmlRendering(ctx, indexer, umlId, format)
+	switch {
+	case err == errUnsupportedRenderingFormat:
+		log.Warningf(ctx, "%s: %s", err, format)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case err == datastore.ErrNoSuchEntity:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case isDiagramError(err):
+		log.Warningf(ctx, "failed to render %s: %s", format, err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	case err == errRendererUnavailable:
+		log.Warningf(ctx, "%s", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		log.Criticalf(ctx, "failed to render %s: %s", format, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", renderingContentTypes[format])
+	w.Write(data)
+}
+
+func HandleSvgSavings(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	savings, err := FetchSvgSavings(ctx)
+	if err != nil {
+		log.Criticalf(ctx, "failed to fetch svg savings: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if savings == nil {
+		log.Warningf(ctx, "optimize-svg migration has never run")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(savings)
+}
+
+func HandleIndexAttemptList(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	queryParams := r.URL.Query()
+	umlId, _ := strconv.ParseInt(queryParams.Get("umlId"), 10, 64)
+	query := &IndexAttemptQuery{
+		Url:     queryParams.Get("url"),
+		UmlId:   umlId,
+		Outcome: SourceOutcome(queryParams.Get("outcome")),
+		Cursor:  queryParams.Get("cursor"),
+	}
+
+	attempts, nextCursor, err := FetchIndexAttempts(ctx, query)
+	if err == errInvalidCursor {
+		log.Warningf(ctx, "%s: %s", err, query.Cursor)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Criticalf(ctx, "failed to fetch index attempts: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&IndexAttemptListResponseBody{
+		Attempts:   attempts,
+		NextCursor: nextCursor,
+	})
+}
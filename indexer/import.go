@@ -0,0 +1,225 @@
+package indexer
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	INDEX_CREATE_QUEUE = "index-create-queue"
+)
+
+var errNoImportUrls = errors.New("no urls specified")
+
+type ImportPriority string
+
+const (
+	PriorityHigh   ImportPriority = "high"
+	PriorityNormal ImportPriority = "normal"
+	PriorityLow    ImportPriority = "low"
+)
+
+func (p ImportPriority) IsValid() bool {
+	return p == PriorityHigh || p == PriorityNormal || p == PriorityLow
+}
+
+type ImportOrigin string
+
+const (
+	OriginApi ImportOrigin = "api"
+	OriginGcs ImportOrigin = "gcs"
+)
+
+type Import struct {
+	Origin    ImportOrigin `datastore:"origin"`
+	ObjectId  string       `datastore:"objectId"`
+	Queued    int          `datastore:"queued,noindex"`
+	CreatedAt time.Time    `datastore:"createdAt"`
+}
+
+type ImportOutcome string
+
+const (
+	OutcomeProcessed ImportOutcome = "processed"
+	OutcomeSkipped   ImportOutcome = "skipped"
+	OutcomeFailed    ImportOutcome = "failed"
+)
+
+// ImportResult is the result of one URL of an import.
+// It's keyed by import ID and URL so a retried task overwrites its previous result.
+type ImportResult struct {
+	ImportId  int64         `datastore:"importId"`
+	Url       string        `datastore:"url,noindex"`
+	Outcome   ImportOutcome `datastore:"outcome"`
+	UpdatedAt time.Time     `datastore:"updatedAt,noindex"`
+}
+
+type ImportItem struct {
+	Url      string         `json:"url"`
+	Tags     []string       `json:"tags,omitempty"`
+	Priority ImportPriority `json:"priority,omitempty"`
+}
+
+type ImportStatus struct {
+	Id        int64        `json:"id"`
+	Origin    ImportOrigin `json:"origin"`
+	Queued    int          `json:"queued"`
+	Processed int          `json:"processed"`
+	Skipped   int          `json:"skipped"`
+	Failed    int          `json:"failed"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+// CreateImport registers a new import and schedules an index creation per URL, and returns the number of scheduled ones.
+// Duplicate URLs are scheduled once, because their results are recorded as one.
+// If scheduling fails halfway, the import is registered with the scheduled ones and the error is returned.
+func CreateImport(ctx context.Context, origin ImportOrigin, objectId string, items []*ImportItem) (int64, int, error) {
+	items = dedupeImportItems(items)
+
+	// the ID is allocated first, so that the import is saved with the number of actually scheduled ones
+	importId, _, err := datastore.AllocateIDs(ctx, "Import", nil, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	queued, scheduleErr := schedulePendingIndexes(ctx, importId, items)
+	imp := &Import{
+		Origin:    origin,
+		ObjectId:  objectId,
+		Queued:    queued,
+		CreatedAt: time.Now(),
+	}
+	key := datastore.NewKey(ctx, "Import", "", importId, nil)
+	if _, err := datastore.Put(ctx, key, imp); err != nil {
+		return 0, 0, err
+	}
+	if scheduleErr != nil {
+		return importId, queued, scheduleErr
+	}
+
+	return importId, queued, nil
+}
+
+// dedupeImportItems drops items whose URL appears earlier.
+func dedupeImportItems(items []*ImportItem) []*ImportItem {
+	seen := make(map[string]bool)
+	var deduped []*ImportItem
+	for _, item := range items {
+		if seen[item.Url] {
+			continue
+		}
+		seen[item.Url] = true
+		deduped = append(deduped, item)
+	}
+	return deduped
+}
+
+// parseImportItems reads items of the import API, which is a JSON of ImportCreateRequestBody
+// or NDJSON of ImportItem, or a text of a URL per line such as files uploaded to GCS.
+// The priority is normal if it's not specified.
+func parseImportItems(contentType string, body io.Reader) ([]*ImportItem, error) {
+	var items []*ImportItem
+	ndjson := strings.HasPrefix(contentType, "application/x-ndjson")
+	if ndjson || strings.HasPrefix(contentType, "text/plain") {
+		// one item per line
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			item := ImportItem{Url: line}
+			if ndjson {
+				item = ImportItem{}
+				if err := json.Unmarshal([]byte(line), &item); err != nil {
+					return nil, err
+				}
+			}
+			items = append(items, &item)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		var req ImportCreateRequestBody
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return nil, err
+		}
+		for _, url := range req.Urls {
+			items = append(items, &ImportItem{
+				Url:      url,
+				Tags:     req.Tags,
+				Priority: req.Priority,
+			})
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, errNoImportUrls
+	}
+	for _, item := range items {
+		if item.Priority == "" {
+			item.Priority = PriorityNormal
+		}
+		if item.Url == "" || !item.Priority.IsValid() {
+			return nil, fmt.Errorf("invalid import item: %#v", item)
+		}
+	}
+	return items, nil
+}
+
+func RecordImportResult(ctx context.Context, importId int64, url string, outcome ImportOutcome) error {
+	hash := sha256.Sum256([]byte(url))
+	keyName := fmt.Sprintf("%d:%s", importId, hex.EncodeToString(hash[:]))
+	key := datastore.NewKey(ctx, "ImportResult", keyName, 0, nil)
+	_, err := datastore.Put(ctx, key, &ImportResult{
+		ImportId:  importId,
+		Url:       url,
+		Outcome:   outcome,
+		UpdatedAt: time.Now(),
+	})
+	return err
+}
+
+func FetchImportStatus(ctx context.Context, importId int64) (*ImportStatus, error) {
+	var imp Import
+	key := datastore.NewKey(ctx, "Import", "", importId, nil)
+	if err := datastore.Get(ctx, key, &imp); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	status := &ImportStatus{
+		Id:        importId,
+		Origin:    imp.Origin,
+		Queued:    imp.Queued,
+		CreatedAt: imp.CreatedAt,
+	}
+	counts := map[ImportOutcome]*int{
+		OutcomeProcessed: &status.Processed,
+		OutcomeSkipped:   &status.Skipped,
+		OutcomeFailed:    &status.Failed,
+	}
+	for outcome, count := range counts {
+		q := datastore.NewQuery("ImportResult").Filter("importId =", importId).Filter("outcome =", outcome).KeysOnly()
+		n, err := q.Count(ctx)
+		if err != nil {
+			return nil, err
+		}
+		*count = n
+	}
+
+	return status, nil
+}
@@ -0,0 +1,80 @@
+package indexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseImportItems(t *testing.T) {
+	var tests = []struct {
+		contentType string
+		body        string
+		expected    []ImportItem
+		valid       bool
+	}{
+		{
+			"application/json",
+			`{"urls": ["https://github.com/a/b/blob/master/a.puml", "https://github.com/a/b/blob/master/b.puml"], "tags": ["x"], "priority": "high"}`,
+			[]ImportItem{
+				{Url: "https://github.com/a/b/blob/master/a.puml", Tags: []string{"x"}, Priority: PriorityHigh},
+				{Url: "https://github.com/a/b/blob/master/b.puml", Tags: []string{"x"}, Priority: PriorityHigh},
+			},
+			true,
+		},
+		{
+			"application/x-ndjson",
+			"{\"url\": \"https://github.com/a/b/blob/master/a.puml\"}\n\n{\"url\": \"https://github.com/a/b/blob/master/b.puml\", \"priority\": \"low\"}\n",
+			[]ImportItem{
+				{Url: "https://github.com/a/b/blob/master/a.puml", Priority: PriorityNormal},
+				{Url: "https://github.com/a/b/blob/master/b.puml", Priority: PriorityLow},
+			},
+			true,
+		},
+		{
+			"text/plain; charset=utf-8",
+			"https://github.com/a/b/blob/master/a.puml\n\n  https://github.com/a/b/blob/master/b.puml  \n",
+			[]ImportItem{
+				{Url: "https://github.com/a/b/blob/master/a.puml", Priority: PriorityNormal},
+				{Url: "https://github.com/a/b/blob/master/b.puml", Priority: PriorityNormal},
+			},
+			true,
+		},
+		{"application/json", `{"urls": []}`, nil, false},
+		{"text/plain", "\n\n", nil, false},
+		{"application/json", `{"urls": ["https://github.com/a/b/blob/master/a.puml"], "priority": "urgent"}`, nil, false},
+		{"application/json", `{"urls": [""]}`, nil, false},
+		{"application/x-ndjson", "{\"url\": ", nil, false},
+	}
+
+	for _, test := range tests {
+		items, err := parseImportItems(test.contentType, strings.NewReader(test.body))
+		if !test.valid {
+			if err == nil {
+				t.Errorf("invalid body should be rejected: body=%s", test.body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("valid body should be accepted: body=%s, err=%s", test.body, err)
+			continue
+		}
+		if len(items) != len(test.expected) {
+			t.Errorf("not expected items: body=%s, got=%d, expected=%d", test.body, len(items), len(test.expected))
+			continue
+		}
+		for i, item := range items {
+			expected := test.expected[i]
+			if item.Url != expected.Url || item.Priority != expected.Priority || strings.Join(item.Tags, ",") != strings.Join(expected.Tags, ",") {
+				t.Errorf("not expected item: got=%#v, expected=%#v", item, expected)
+			}
+		}
+	}
+}
+
+func TestDedupeImportItems(t *testing.T) {
+	items := []*ImportItem{{Url: "a", Priority: PriorityHigh}, {Url: "b"}, {Url: "a", Priority: PriorityLow}}
+	got := dedupeImportItems(items)
+	if len(got) != 2 || got[0].Url != "a" || got[0].Priority != PriorityHigh || got[1].Url != "b" {
+		t.Errorf("not expected items: got=%#v", got)
+	}
+}
@@ -1,35 +1,67 @@
 package indexer
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	pngpkg "image/png"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/yfuruyama/real-world-plantuml/blobstore"
+	"github.com/yfuruyama/real-world-plantuml/svgsanitizer"
 
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/search"
 )
 
-const (
-	MINIMUM_UML_SOURCE_LENGTH = 50
-)
-
 type Indexer struct {
-	Renderer      *Renderer
+	Renderer      Renderer
 	SyntaxChecker *SyntaxChecker
+	Policy        *InclusionPolicy
+	Blobs         blobstore.Store
+	// Breaker is optional. If it's open, rendering fails with errRendererUnavailable.
+	Breaker *CircuitBreaker
+	// RateLimited takes tokens of the renderer bucket for each format before rendering,
+	// and rendering fails with errRendererUnavailable if the bucket runs out.
+	RateLimited bool
 }
 
+// renderFormats are the formats of a source which are stored in Uml.
+var renderFormats = []RenderFormat{FormatSvg, FormatPng, FormatAscii}
+
 type Uml struct {
 	GitHubUrl    string      `datastore:"gitHubUrl"`
 	Source       string      `datastore:"source,noindex"`
 	SourceSHA256 string      `datastore:"sourceSHA256"`
+	EncodedId    string      `datastore:"encodedId,noindex"`
 	DiagramType  DiagramType `datastore:"diagramType"`
-	Svg          string      `datastore:"svg,noindex"`
-	PngBase64    string      `datastore:"pngBase64,noindex"`
-	Ascii        string      `datastore:"ascii,noindex"`
+	// SyntaxDiagramType is the type given by the syntax checker, such as "DESCRIPTION",
+	// which is kept to classify the diagram again without checking it
+	SyntaxDiagramType string `datastore:"syntaxDiagramType"`
+	// SvgRef is the optimized SVG for pages, and SvgOriginalRef is the rendered one for downloads
+	SvgRef         string `datastore:"svgRef,noindex"`
+	SvgOriginalRef string `datastore:"svgOriginalRef,noindex"`
+	PngRef         string `datastore:"pngRef,noindex"`
+	AsciiRef       string `datastore:"asciiRef,noindex"`
+	// SvgSize and SvgOriginalSize are in bytes, which the "optimize-svg" migration sums to report savings
+	SvgSize         int `datastore:"svgSize,noindex"`
+	SvgOriginalSize int `datastore:"svgOriginalSize,noindex"`
+	// Thumbnails are scaled down from the PNG in THUMBNAIL_SIZES
+	Thumbnails []UmlThumbnail `datastore:"thumbnails"`
+	// RendererVersion is the PlantUML version which rendered the assets
+	RendererVersion string   `datastore:"rendererVersion"`
+	Tags            []string `datastore:"tags"`
+	// Svg, PngBase64 and Ascii were stored inline before the blob store,
+	// and are emptied by the "uml-blobs" migration.
+	Svg       string `datastore:"svg,noindex"`
+	PngBase64 string `datastore:"pngBase64,noindex"`
+	Ascii     string `datastore:"ascii,noindex"`
 }
 
 type DiagramType string
@@ -39,128 +71,457 @@ type FTSDocument struct {
 }
 
 const (
-	TypeSequence  DiagramType = "sequence"
-	TypeUsecase   DiagramType = "usecase"
-	TypeClass     DiagramType = "class"
-	TypeActivity  DiagramType = "activity"
-	TypeComponent DiagramType = "component"
-	TypeState     DiagramType = "state"
-	// TypeObject    DiagramType = "object" // object is rarely detected
-	TypeUnknwon DiagramType = "__unknown__"
+	TypeSequence   DiagramType = "sequence"
+	TypeUsecase    DiagramType = "usecase"
+	TypeClass      DiagramType = "class"
+	TypeActivity   DiagramType = "activity"
+	TypeComponent  DiagramType = "component"
+	TypeState      DiagramType = "state"
+	TypeObject     DiagramType = "object"
+	TypeDeployment DiagramType = "deployment"
+	TypeTiming     DiagramType = "timing"
+	TypeNetwork    DiagramType = "network"
+	TypeER         DiagramType = "er"
+	TypeArchimate  DiagramType = "archimate"
+	TypeUnknwon    DiagramType = "__unknown__"
 )
 
-func guessDiagramType(source string, result *SyntaxCheckResult) DiagramType {
-	switch result.DiagramType {
-	case "SEQUENCE":
-		return TypeSequence
-	case "DESCRIPTION":
-		// Both of Usecase and Component diagram's syntax check results are "DESCRIPTION",
-		// so distinct them ad hoc
-		if strings.Contains(source, "actor") || strings.Contains(source, "usecase") {
-			return TypeUsecase
-		} else {
-			return TypeComponent
-		}
-	case "CLASS":
-		return TypeClass
-	case "ACTIVITY":
-		return TypeActivity
-	case "STATE":
-		return TypeState
-	default:
-		return TypeUnknwon
-	}
-}
-
-func NewIndexer(renderer *Renderer, syntaxChecker *SyntaxChecker) *Indexer {
+func NewIndexer(renderer Renderer, syntaxChecker *SyntaxChecker, policy *InclusionPolicy, blobs blobstore.Store) *Indexer {
 	return &Indexer{
 		Renderer:      renderer,
 		SyntaxChecker: syntaxChecker,
+		Policy:        policy,
+		Blobs:         blobs,
 	}
 }
 
-func (idxr *Indexer) CreateIndexes(ctx context.Context, text string, gitHubUrl string) error {
-	renderer := idxr.Renderer
-	syntaxChecker := idxr.SyntaxChecker
+// Close releases the blob store, which is created for each request.
+func (idxr *Indexer) Close() error {
+	return idxr.Blobs.Close()
+}
 
-	sources := findSources(ctx, text)
-	for _, source := range sources {
-		log.Infof(ctx, "process source: %s", source)
-		if len(source) < MINIMUM_UML_SOURCE_LENGTH {
-			log.Infof(ctx, "under minimum length: length=%d", len(source))
-			continue
-		}
+// SourceReport is the result of each step of the indexing pipeline for a source.
+type SourceReport struct {
+	Source          string             `json:"source"`
+	SourceSHA256    string             `json:"sourceSHA256"`
+	EncodedId       string             `json:"encodedId"`
+	Length          int                `json:"length"`
+	Rejections      []*PolicyRejection `json:"rejections,omitempty"`
+	DuplicateOf     int64              `json:"duplicateOf,omitempty"`
+	SyntaxCheck     *SyntaxCheckResult `json:"syntaxCheck,omitempty"`
+	HasValidDiagram bool               `json:"hasValidDiagram"`
+	DiagramType     DiagramType        `json:"diagramType,omitempty"`
+	Svg             string             `json:"svg,omitempty"`
+	PngBase64       string             `json:"pngBase64,omitempty"`
+	Ascii           string             `json:"ascii,omitempty"`
+	PngWidth        int                `json:"pngWidth,omitempty"`
+	PngHeight       int                `json:"pngHeight,omitempty"`
+	RendererVersion string             `json:"rendererVersion,omitempty"`
+	RenderError     string             `json:"renderError,omitempty"`
+	// DiagramError is reported by the renderer for the source, while RenderError is of the renderer itself
+	DiagramError     string `json:"diagramError,omitempty"`
+	DiagramErrorLine int    `json:"diagramErrorLine,omitempty"`
+}
 
-		hash := sha256.Sum256([]byte(source))
-		sourceHash := hex.EncodeToString(hash[:])
-		log.Debugf(ctx, "source hash: %s", sourceHash)
+// ErrorMessage is the error of the source which is reported by the renderer or the syntax checker.
+func (r *SourceReport) ErrorMessage() string {
+	if r.DiagramError != "" {
+		return r.DiagramError
+	}
+	if r.SyntaxCheck != nil {
+		return r.SyntaxCheck.ErrorMessage()
+	}
+	return ""
+}
+
+func (r *SourceReport) Indexable() bool {
+	return len(r.Rejections) == 0 && r.DuplicateOf == 0 && r.SyntaxCheck != nil && r.SyntaxCheck.Valid && r.HasValidDiagram && r.DiagramError == "" && r.RenderError == ""
+}
+
+// screenSource runs the steps of the pipeline before the syntax check, which are the policy of the source
+// and the duplicate check. Both run for every source, so that the report tells every reason in previews.
+func (idxr *Indexer) screenSource(ctx context.Context, source string) (*SourceReport, error) {
+	hash := sha256.Sum256([]byte(source))
+	report := &SourceReport{
+		Source:       source,
+		SourceSHA256: hex.EncodeToString(hash[:]),
+		Length:       len(source),
+	}
+	log.Debugf(ctx, "source hash: %s", report.SourceSHA256)
+
+	encodedId, err := EncodeUml(source)
+	if err != nil {
+		return nil, err
+	}
+	report.EncodedId = encodedId
+
+	if rejection := idxr.Policy.CheckSource(source); rejection != nil {
+		log.Infof(ctx, "rejected by policy: %s", rejection)
+		report.Rejections = append(report.Rejections, rejection)
+	}
+
+	q := datastore.NewQuery("Uml").Filter("sourceSHA256 =", report.SourceSHA256).Limit(1).KeysOnly()
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		log.Criticalf(ctx, "failed to fetch existing umls: %v", err)
+		return nil, err
+	}
+	if len(keys) == 1 {
+		log.Infof(ctx, "there is same uml existing: id=%d", keys[0].IntID())
+		report.DuplicateOf = keys[0].IntID()
+	}
+	return report, nil
+}
 
-		var existing []Uml
-		q := datastore.NewQuery("Uml").Filter("sourceSHA256 =", sourceHash).Limit(1)
-		_, err := q.GetAll(ctx, &existing)
+// screenSources runs screenSource for each source. It returns the index of the source which fails.
+func (idxr *Indexer) screenSources(ctx context.Context, sources []string) ([]*SourceReport, int, error) {
+	reports := make([]*SourceReport, len(sources))
+	for i, source := range sources {
+		report, err := idxr.screenSource(ctx, source)
 		if err != nil {
-			log.Criticalf(ctx, "failed to fetch existing umls: %v", err)
-			return err
+			return nil, i, err
+		}
+		reports[i] = report
+	}
+	return reports, 0, nil
+}
+
+// checkSyntaxBatch checks screened sources of a file in a single call. Sources which are rejected by the policy
+// or already indexed are not sent, and a source which appears more than once is sent once.
+// The result of a source is nil if it's not sent, or if the check fails for it or for the whole batch,
+// then the source is checked alone later if needed.
+func (idxr *Indexer) checkSyntaxBatch(ctx context.Context, reports []*SourceReport) []*SyntaxCheckResult {
+	sources := make([]string, len(reports))
+	for i, report := range reports {
+		sources[i] = report.Source
+	}
+	batch, positions := planSyntaxCheckBatch(sources, func(i int) bool {
+		return len(reports[i].Rejections) > 0 || reports[i].DuplicateOf != 0
+	})
+	if len(batch) == 0 {
+		return make([]*SyntaxCheckResult, len(sources))
+	}
+
+	items, err := idxr.SyntaxChecker.CheckSyntaxBatch(batch)
+	if err != nil {
+		log.Warningf(ctx, "failed to check syntax in batch, check one by one: %s", err)
+		return make([]*SyntaxCheckResult, len(sources))
+	}
+	for i, item := range items {
+		if item.Error != "" || item.Result == nil {
+			log.Warningf(ctx, "failed to check syntax of source %d in batch: %s", i, item.Error)
 		}
-		if len(existing) == 1 {
-			log.Infof(ctx, "there is same uml existing: %#v", existing[0])
+	}
+	return syntaxCheckBatchResults(positions, items)
+}
+
+// planSyntaxCheckBatch returns the sources to send, and the position of each source in them,
+// which is -1 if the source is skipped. A repeated source follows the first one.
+func planSyntaxCheckBatch(sources []string, skip func(i int) bool) ([]string, []int) {
+	var batch []string
+	positions := make([]int, len(sources))
+	seen := make(map[string]int)
+	for i, source := range sources {
+		if position, ok := seen[source]; ok {
+			positions[i] = position
 			continue
 		}
+		if skip(i) {
+			positions[i] = -1
+		} else {
+			positions[i] = len(batch)
+			batch = append(batch, source)
+		}
+		seen[source] = positions[i]
+	}
+	return batch, positions
+}
 
-		result, err := syntaxChecker.CheckSyntax(source)
+// syntaxCheckBatchResults returns the result of each source by the positions of planSyntaxCheckBatch.
+// The result is nil if the source is skipped or the check fails for it.
+func syntaxCheckBatchResults(positions []int, items []SyntaxCheckBatchItem) []*SyntaxCheckResult {
+	results := make([]*SyntaxCheckResult, len(positions))
+	for i, position := range positions {
+		if position < 0 || position >= len(items) || items[position].Error != "" {
+			continue
+		}
+		results[i] = items[position].Result
+	}
+	return results
+}
+
+// evaluateSource runs the indexing pipeline for the source screened by screenSource without writing anything.
+// The syntax is checked unless the result is given by checkSyntaxBatch.
+// If dryRun is false, it stops at the first step that rejects the source,
+// otherwise it runs every step to report why the source would be rejected.
+func (idxr *Indexer) evaluateSource(ctx context.Context, report *SourceReport, checked *SyntaxCheckResult, dryRun bool) (*SourceReport, error) {
+	source := report.Source
+	if !dryRun && (len(report.Rejections) > 0 || report.DuplicateOf != 0) {
+		return report, nil
+	}
+
+	result := checked
+	if result == nil {
+		var err error
+		result, err = idxr.SyntaxChecker.CheckSyntax(source)
 		if err != nil {
 			log.Criticalf(ctx, "failed to check syntax: %s", err)
-			return err
+			return nil, err
 		}
-		log.Infof(ctx, "syntax check result: %v", result)
+	}
+	log.Infof(ctx, "syntax check result: %v", result)
+	report.SyntaxCheck = result
+	report.HasValidDiagram = result.HasValidDiagram()
 
-		if !result.Valid {
-			log.Infof(ctx, "invalid syntax: %s", source)
-			continue
+	if !result.Valid {
+		log.Infof(ctx, "invalid syntax: %s", source)
+		if !dryRun {
+			return report, nil
 		}
-		if !result.HasValidDiagram() {
-			log.Infof(ctx, "invalid diagram: %s", source)
-			continue
+	}
+	if !report.HasValidDiagram {
+		log.Infof(ctx, "invalid diagram: %s", source)
+		if !dryRun {
+			return report, nil
 		}
+	}
 
-		typ := guessDiagramType(source, result)
+	report.DiagramType = classifyDiagram(source, result.DiagramType)
 
-		svg, err := renderer.RenderSvg(source)
-		if err != nil {
-			log.Criticalf(ctx, "failed to render svg: %s", err)
+	if rejection := idxr.Policy.CheckDiagram(report.DiagramType, result.Elements()); rejection != nil {
+		log.Infof(ctx, "rejected by policy: %s", rejection)
+		report.Rejections = append(report.Rejections, rejection)
+		if !dryRun {
+			return report, nil
+		}
+	}
+
+	if err := idxr.render(ctx, report); err != nil {
+		// the diagram is rejected, while the other errors fail the task to be retried
+		if renderErr, ok := err.(*RenderError); ok && !renderErr.Temporary() {
+			log.Infof(ctx, "rejected by render error: %s", renderErr)
+			report.DiagramError = renderErr.Message
+			report.DiagramErrorLine = renderErr.Line
+			return report, nil
+		}
+		if !dryRun {
+			return nil, err
+		}
+		report.RenderError = err.Error()
+		return report, nil
+	}
+
+	if rejection := idxr.Policy.CheckRendered(report.PngWidth, report.PngHeight); rejection != nil {
+		log.Infof(ctx, "rejected by policy: %s", rejection)
+		report.Rejections = append(report.Rejections, rejection)
+	}
+
+	return report, nil
+}
+
+func (idxr *Indexer) render(ctx context.Context, report *SourceReport) error {
+	formats := renderFormats
+	if err := idxr.takeRendererTokens(ctx, len(formats)); err != nil {
+		return err
+	}
+	if idxr.Breaker != nil && !idxr.Breaker.Allow(time.Now()) {
+		return errRendererUnavailable
+	}
+
+	results := make([][]byte, len(formats))
+	errs := make([]error, len(formats))
+
+	// the other formats are canceled as soon as one fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, format := range formats {
+		wg.Add(1)
+		go func(i int, format RenderFormat) {
+			defer wg.Done()
+			results[i], errs[i] = renderWithRetry(ctx, idxr.Renderer, report.Source, format)
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i, format)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if isDiagramError(err) {
+			// the renderer is healthy even if the diagram is wrong
+			if idxr.Breaker != nil {
+				idxr.Breaker.RecordSuccess()
+			}
 			return err
 		}
+	}
+	for i, err := range errs {
+		if _, ok := err.(*RenderTimeoutError); ok {
+			// the deadline of the source is exceeded, which doesn't mean the renderer is down
+			log.Warningf(ctx, "failed to render %s: %s", formats[i], err)
+			if idxr.Breaker != nil {
+				idxr.Breaker.Release()
+			}
+			return err
+		}
+	}
+	for i, err := range errs {
+		if err != nil && err != context.Canceled {
+			log.Criticalf(ctx, "failed to render %s: %s", formats[i], err)
+			if idxr.Breaker != nil {
+				idxr.Breaker.RecordFailure(time.Now())
+			}
+			return err
+		}
+	}
+	// canceled by the caller
+	if ctx.Err() != nil {
+		if idxr.Breaker != nil {
+			idxr.Breaker.Release()
+		}
+		return ctx.Err()
+	}
+	if idxr.Breaker != nil {
+		idxr.Breaker.RecordSuccess()
+	}
+	png, ascii := results[1], results[2]
+
+	// sources come from arbitrary repositories, and the SVG is inlined in pages
+	svg, err := svgsanitizer.Sanitize(results[0])
+	if err != nil {
+		log.Criticalf(ctx, "failed to sanitize svg: %s", err)
+		return err
+	}
 
-		png, err := renderer.RenderPng(source)
+	pngConfig, err := pngpkg.DecodeConfig(bytes.NewReader(png))
+	if err != nil {
+		log.Criticalf(ctx, "failed to decode png: %s", err)
+		return err
+	}
+
+	// the version is unknown if the renderer doesn't support the version diagram
+	if version, err := RendererVersion(ctx, idxr.Renderer); err == nil {
+		report.RendererVersion = version
+	} else {
+		log.Warningf(ctx, "failed to detect renderer version: %s", err)
+	}
+
+	report.Svg = string(svg)
+	report.PngBase64 = base64.StdEncoding.EncodeToString(png)
+	report.PngWidth = pngConfig.Width
+	report.PngHeight = pngConfig.Height
+	report.Ascii = string(ascii)
+	return nil
+}
+
+// takeRendererTokens takes a token of the renderer bucket for each renderer call.
+// Outputs in the render cache are counted as well, which makes the rate an upper bound.
+func (idxr *Indexer) takeRendererTokens(ctx context.Context, n int) error {
+	if !idxr.RateLimited {
+		return nil
+	}
+	taken, err := takeHostTokens(ctx, RENDERER_BUCKET, n, false)
+	if err != nil {
+		return err
+	}
+	if !taken {
+		log.Warningf(ctx, "renderer bucket is empty")
+		return errRendererUnavailable
+	}
+	return nil
+}
+
+// PreviewIndexes reports how each source in the text would be indexed, without writing anything.
+func (idxr *Indexer) PreviewIndexes(ctx context.Context, text string) ([]*SourceReport, error) {
+	sources := findSources(ctx, text)
+	screened, _, err := idxr.screenSources(ctx, sources)
+	if err != nil {
+		return nil, err
+	}
+	checked := idxr.checkSyntaxBatch(ctx, screened)
+	reports := make([]*SourceReport, 0, len(sources))
+	for i, report := range screened {
+		report, err := idxr.evaluateSource(ctx, report, checked[i], true)
 		if err != nil {
-			log.Criticalf(ctx, "failed to render png: %s", err)
-			return err
+			return nil, err
 		}
-		pngBase64 := base64.StdEncoding.EncodeToString(png)
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
 
-		ascii, err := renderer.RenderAscii(source)
+// CreateIndexes returns the outcome of each source for the audit log, even if it fails midway.
+func (idxr *Indexer) CreateIndexes(ctx context.Context, text string, gitHubUrl string, tags []string) ([]IndexAttemptSource, error) {
+	var results []IndexAttemptSource
+	sources := findSources(ctx, text)
+	screened, failed, err := idxr.screenSources(ctx, sources)
+	if err != nil {
+		results = append(results, failedAttemptSource(sources[failed], err))
+		return results, err
+	}
+	checked := idxr.checkSyntaxBatch(ctx, screened)
+	// Umls created by this file, because the same source may appear more than once
+	created := make(map[string]int64)
+	for i, source := range sources {
+		log.Infof(ctx, "process source: %s", source)
+
+		if umlId, ok := created[screened[i].SourceSHA256]; ok && screened[i].DuplicateOf == 0 {
+			log.Infof(ctx, "there is same uml created: id=%d", umlId)
+			screened[i].DuplicateOf = umlId
+		}
+		report, err := idxr.evaluateSource(ctx, screened[i], checked[i], false)
 		if err != nil {
-			log.Criticalf(ctx, "failed to render ascii: %s", err)
-			return err
+			results = append(results, failedAttemptSource(source, err))
+			return results, err
+		}
+		if !report.Indexable() {
+			if invalid := newInvalidUml(report, gitHubUrl, tags); invalid != nil {
+				if err := putInvalidUml(ctx, invalid); err != nil {
+					log.Criticalf(ctx, "failed to put invalid uml: %s", err)
+					results = append(results, failedAttemptSource(source, err))
+					return results, err
+				}
+			}
+			results = append(results, IndexAttemptSource{
+				SourceSHA256: report.SourceSHA256,
+				Outcome:      report.Outcome(),
+				UmlId:        report.DuplicateOf,
+				Error:        report.ErrorMessage(),
+			})
+			continue
 		}
 
-		log.Infof(ctx, "make index: type=%s, svg=%s, pngBase64=%s, ascii=%s", typ, svg, pngBase64, ascii)
+		log.Infof(ctx, "make index: type=%s, svg=%s, pngBase64=%s, ascii=%s", report.DiagramType, report.Svg, report.PngBase64, report.Ascii)
 		uml := &Uml{
-			GitHubUrl:    gitHubUrl,
-			Source:       source,
-			SourceSHA256: sourceHash,
-			DiagramType:  typ,
-			Svg:          svg,
-			PngBase64:    pngBase64,
-			Ascii:        ascii,
+			GitHubUrl:         gitHubUrl,
+			Source:            source,
+			SourceSHA256:      report.SourceSHA256,
+			EncodedId:         report.EncodedId,
+			DiagramType:       report.DiagramType,
+			SyntaxDiagramType: report.SyntaxCheck.DiagramType,
+			RendererVersion:   report.RendererVersion,
+			Tags:              tags,
+		}
+		if err := putUmlAssets(ctx, idxr.Blobs, uml, report.Svg, report.PngBase64, report.Ascii); err != nil {
+			log.Criticalf(ctx, "failed to put assets: %s", err)
+			results = append(results, failedAttemptSource(source, err))
+			return results, err
 		}
 
 		key := datastore.NewIncompleteKey(ctx, "Uml", nil)
 		key, err = datastore.Put(ctx, key, uml)
 		if err != nil {
 			log.Criticalf(ctx, "put error: %s", err)
-			return err
+			results = append(results, failedAttemptSource(source, err))
+			return results, err
 		}
+		created[report.SourceSHA256] = key.IntID()
+		results = append(results, IndexAttemptSource{
+			SourceSHA256: report.SourceSHA256,
+			Outcome:      SourceOutcomeRendered,
+			UmlId:        key.IntID(),
+		})
 
 		// Register to full-text search index
 		doc := FTSDocument{
@@ -169,7 +530,7 @@ func (idxr *Indexer) CreateIndexes(ctx context.Context, text string, gitHubUrl s
 		fts, err := search.Open("uml_source")
 		if err != nil {
 			log.Criticalf(ctx, "failed to open FTS: %s", err)
-			return err
+			return results, err
 		}
 		_, err = fts.Put(ctx, fmt.Sprintf("%d", key.IntID()), &doc)
 		if err != nil {
@@ -179,7 +540,16 @@ func (idxr *Indexer) CreateIndexes(ctx context.Context, text string, gitHubUrl s
 		}
 	}
 
-	return nil
+	return results, nil
+}
+
+func failedAttemptSource(source string, err error) IndexAttemptSource {
+	hash := sha256.Sum256([]byte(source))
+	return IndexAttemptSource{
+		SourceSHA256: hex.EncodeToString(hash[:]),
+		Outcome:      SourceOutcomeFailed,
+		Error:        err.Error(),
+	}
 }
 
 func findSources(ctx context.Context, text string) []string {
@@ -1,6 +1,7 @@
 package indexer
 
 import (
+	"fmt"
 	"testing"
 
 	"google.golang.org/appengine/aetest"
@@ -64,3 +65,77 @@ func isSameSources(got []string, expected []string) bool {
 	}
 	return true
 }
+
+func TestSourceReportOutcome(t *testing.T) {
+	valid := &SyntaxCheckResult{Valid: true}
+	invalid := &SyntaxCheckResult{Valid: false}
+
+	var tests = []struct {
+		report   SourceReport
+		expected SourceOutcome
+	}{
+		{SourceReport{Rejections: []*PolicyRejection{{Rule: RuleMinSourceLength}}}, SourceOutcomeSkippedShort},
+		{SourceReport{Rejections: []*PolicyRejection{{Rule: RuleBlocklist}}}, SourceOutcomeRejected},
+		{SourceReport{DuplicateOf: 1}, SourceOutcomeDuplicate},
+		{SourceReport{SyntaxCheck: invalid}, SourceOutcomeInvalidSyntax},
+		{SourceReport{SyntaxCheck: valid, HasValidDiagram: false}, SourceOutcomeNoDiagram},
+		{SourceReport{SyntaxCheck: valid, HasValidDiagram: true, RenderError: "timeout"}, SourceOutcomeFailed},
+		{SourceReport{SyntaxCheck: valid, HasValidDiagram: true, DiagramError: "Syntax Error?"}, SourceOutcomeRenderError},
+		{SourceReport{SyntaxCheck: valid, HasValidDiagram: true}, SourceOutcomeRendered},
+	}
+
+	for _, test := range tests {
+		if got := test.report.Outcome(); got != test.expected {
+			t.Errorf("not expected outcome: report=%#v, got=%s, expected=%s", test.report, got, test.expected)
+		}
+	}
+}
+
+func TestPlanSyntaxCheckBatch(t *testing.T) {
+	sources := []string{"a", "rejected", "b", "a", "rejected", "c"}
+	skipped := 0
+	batch, positions := planSyntaxCheckBatch(sources, func(i int) bool {
+		if sources[i] == "rejected" {
+			skipped++
+			return true
+		}
+		return false
+	})
+
+	if fmt.Sprint(batch) != fmt.Sprint([]string{"a", "b", "c"}) {
+		t.Errorf("not expected batch: got=%v", batch)
+	}
+	if fmt.Sprint(positions) != fmt.Sprint([]int{0, -1, 1, 0, -1, 2}) {
+		t.Errorf("not expected positions: got=%v", positions)
+	}
+	if skipped != 1 {
+		t.Errorf("a repeated source should be checked once: got=%d", skipped)
+	}
+}
+
+func TestSyntaxCheckBatchResults(t *testing.T) {
+	valid := &SyntaxCheckResult{Valid: true}
+	invalid := &SyntaxCheckResult{Valid: false}
+	positions := []int{0, -1, 1, 0, 2}
+
+	// a source whose check fails is checked alone later
+	items := []SyntaxCheckBatchItem{{Result: valid}, {Error: "java.lang.StackOverflowError"}, {Result: invalid}}
+	results := syntaxCheckBatchResults(positions, items)
+	expected := []*SyntaxCheckResult{valid, nil, nil, valid, invalid}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Errorf("not expected result %d: got=%v, expected=%v", i, results[i], expected[i])
+		}
+	}
+
+	// so are all sources if the whole batch fails
+	results = syntaxCheckBatchResults(positions, nil)
+	if len(results) != len(positions) {
+		t.Fatalf("not expected results: got=%d, expected=%d", len(results), len(positions))
+	}
+	for i, result := range results {
+		if result != nil {
+			t.Errorf("not expected result %d: got=%v", i, result)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package indexer
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+type InvalidUmlCategory string
+
+const (
+	InvalidSyntax  InvalidUmlCategory = "syntax"
+	InvalidInclude InvalidUmlCategory = "include"
+	InvalidEmpty   InvalidUmlCategory = "empty"
+	InvalidRender  InvalidUmlCategory = "render"
+	InvalidOther   InvalidUmlCategory = "other"
+)
+
+// InvalidUml is a source which PlantUML can't draw, kept with the error for linters and regression tests.
+// The key name is SourceSHA256, so that the same source is stored once.
+type InvalidUml struct {
+	GitHubUrl    string             `datastore:"gitHubUrl"`
+	Source       string             `datastore:"source,noindex"`
+	SourceSHA256 string             `datastore:"sourceSHA256"`
+	EncodedId    string             `datastore:"encodedId,noindex"`
+	Category     InvalidUmlCategory `datastore:"category"`
+	// ErrorLine is the line of the first error starting from 1, or 0 if it's unknown
+	ErrorLine   int       `datastore:"errorLine,noindex"`
+	Errors      []string  `datastore:"errors,noindex"`
+	Suggestions []string  `datastore:"suggestions,noindex"`
+	Tags        []string  `datastore:"tags"`
+	CreatedAt   time.Time `datastore:"createdAt"`
+}
+
+// categorizeErrors decides the category of errors reported by the syntax checker.
+func categorizeErrors(errors []string) InvalidUmlCategory {
+	message := strings.ToLower(strings.Join(errors, "\n"))
+	switch {
+	case strings.Contains(message, "cannot include"), strings.Contains(message, "!include"), strings.Contains(message, "cannot open"):
+		return InvalidInclude
+	case strings.Contains(message, "syntax error"):
+		return InvalidSyntax
+	default:
+		return InvalidOther
+	}
+}
+
+// newInvalidUml returns the InvalidUml of the report, or nil if the source is not invalid,
+// such as rejected by the policy or failed to be checked.
+func newInvalidUml(report *SourceReport, gitHubUrl string, tags []string) *InvalidUml {
+	invalid := &InvalidUml{
+		GitHubUrl:    gitHubUrl,
+		Source:       report.Source,
+		SourceSHA256: report.SourceSHA256,
+		EncodedId:    report.EncodedId,
+		Tags:         tags,
+		CreatedAt:    time.Now(),
+	}
+	switch report.Outcome() {
+	case SourceOutcomeInvalidSyntax:
+		invalid.Category = categorizeErrors(report.SyntaxCheck.Errors)
+		invalid.ErrorLine = report.SyntaxCheck.ErrorLine
+		invalid.Errors = report.SyntaxCheck.Errors
+		invalid.Suggestions = report.SyntaxCheck.Suggestions
+	case SourceOutcomeNoDiagram:
+		invalid.Category = InvalidEmpty
+	case SourceOutcomeRenderError:
+		invalid.Category = InvalidRender
+		invalid.ErrorLine = report.DiagramErrorLine
+		invalid.Errors = []string{report.DiagramError}
+	default:
+		return nil
+	}
+	return invalid
+}
+
+// putInvalidUml stores the invalid uml. If the source is already stored, it keeps where and when
+// the source is found first, and updates only the errors, which may change by the syntax checker.
+func putInvalidUml(ctx context.Context, invalid *InvalidUml) error {
+	key := datastore.NewKey(ctx, "InvalidUml", invalid.SourceSHA256, 0, nil)
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var existing InvalidUml
+		err := datastore.Get(ctx, key, &existing)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		entity := *invalid
+		if err == nil {
+			keepFirstOccurrence(&entity, &existing)
+		}
+		_, err = datastore.Put(ctx, key, &entity)
+		return err
+	}, nil)
+}
+
+// keepFirstOccurrence copies where and when the source is found first from the existing one.
+func keepFirstOccurrence(invalid, existing *InvalidUml) {
+	invalid.GitHubUrl = existing.GitHubUrl
+	invalid.Tags = existing.Tags
+	invalid.CreatedAt = existing.CreatedAt
+}
@@ -0,0 +1,52 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewInvalidUml(t *testing.T) {
+	valid := &SyntaxCheckResult{Valid: true}
+	tests := []struct {
+		report   *SourceReport
+		category InvalidUmlCategory
+	}{
+		{&SourceReport{SyntaxCheck: &SyntaxCheckResult{Valid: false, ErrorLine: 2, Errors: []string{"Syntax Error?"}}}, InvalidSyntax},
+		{&SourceReport{SyntaxCheck: &SyntaxCheckResult{Valid: false, Errors: []string{"Cannot include common.puml"}}}, InvalidInclude},
+		{&SourceReport{SyntaxCheck: &SyntaxCheckResult{Valid: false}}, InvalidOther},
+		{&SourceReport{SyntaxCheck: valid, HasValidDiagram: false}, InvalidEmpty},
+		{&SourceReport{SyntaxCheck: valid, HasValidDiagram: true, DiagramError: "Syntax Error?", DiagramErrorLine: 4}, InvalidRender},
+		{&SourceReport{SyntaxCheck: valid, HasValidDiagram: true, RenderError: "timeout"}, ""},
+		{&SourceReport{Rejections: []*PolicyRejection{{RuleMinSourceLength, "too short"}}}, ""},
+	}
+	for _, test := range tests {
+		invalid := newInvalidUml(test.report, "https://github.com/a/b/blob/master/c.puml", nil)
+		if test.category == "" {
+			if invalid != nil {
+				t.Errorf("expected nil for %+v, but got %+v", test.report, invalid)
+			}
+			continue
+		}
+		if invalid == nil || invalid.Category != test.category {
+			t.Errorf("expected %s for %+v, but got %+v", test.category, test.report, invalid)
+		}
+	}
+
+	invalid := newInvalidUml(tests[4].report, "", nil)
+	if invalid.ErrorLine != 4 || len(invalid.Errors) != 1 || invalid.Errors[0] != "Syntax Error?" {
+		t.Errorf("unexpected error details: %+v", invalid)
+	}
+}
+
+func TestKeepFirstOccurrence(t *testing.T) {
+	createdAt := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	existing := &InvalidUml{GitHubUrl: "https://github.com/a/b/blob/master/c.puml", Tags: []string{"first"}, CreatedAt: createdAt, Errors: []string{"old"}}
+	invalid := &InvalidUml{GitHubUrl: "https://github.com/d/e/blob/master/f.puml", Tags: []string{"second"}, CreatedAt: time.Now(), Errors: []string{"new"}}
+	keepFirstOccurrence(invalid, existing)
+	if invalid.GitHubUrl != existing.GitHubUrl || len(invalid.Tags) != 1 || invalid.Tags[0] != "first" || !invalid.CreatedAt.Equal(createdAt) {
+		t.Errorf("not expected first occurrence: got=%+v, expected=%+v", invalid, existing)
+	}
+	if invalid.Errors[0] != "new" {
+		t.Errorf("not expected errors: got=%v, expected=%v", invalid.Errors, []string{"new"})
+	}
+}
@@ -0,0 +1,378 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOCAL_TASK_QUEUE_POLL_INTERVAL = time.Second
+	LOCAL_TASK_QUEUE_TIMEOUT       = 10 * time.Minute
+	LOCAL_TASK_TOKEN_HEADER        = "X-Local-Task-Token"
+	localTaskFileSuffix            = ".json"
+	localDeadTaskDir               = "dead"
+	localDoneTaskDir               = "done"
+	// LOCAL_TASK_TOMBSTONE_TTL is how long names of completed tasks are kept, as Task Queue does
+	LOCAL_TASK_TOMBSTONE_TTL = 7 * 24 * time.Hour
+)
+
+var errNoLocalTaskQueueDir = errors.New("LOCAL_TASK_QUEUE_DIR is not set")
+
+// localTaskToken is generated per process, so that only requests dispatched by LocalTaskQueue
+// of this process are accepted as tasks.
+var localTaskToken = newLocalTaskToken()
+
+func newLocalTaskToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// IsLocalTask reports whether the request is dispatched by LocalTaskQueue in this process.
+func IsLocalTask(r *http.Request) bool {
+	token := r.Header.Get(LOCAL_TASK_TOKEN_HEADER)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(localTaskToken)) == 1
+}
+
+type localTask struct {
+	Name      string      `json:"name"`
+	QueueName string      `json:"queueName"`
+	Path      string      `json:"path"`
+	Payload   []byte      `json:"payload"`
+	Header    http.Header `json:"header,omitempty"`
+	Attempts  int         `json:"attempts"`
+	NextRunAt time.Time   `json:"nextRunAt"`
+	LastError string      `json:"lastError,omitempty"`
+}
+
+// LocalTaskQueue is a persistent task queue backed by the filesystem, so that the indexer
+// can run without App Engine Task Queue, such as by dev_appserver.py on one machine.
+// Tasks are dispatched by a pool of workers as HTTP requests to Target, which is the indexer itself,
+// so that handlers get App Engine contexts as usual. It doesn't run the pipeline without App Engine:
+// handlers still need Datastore and the other App Engine APIs, which dev_appserver.py emulates.
+// Names of completed and dead tasks are kept as tombstones in subdirectories,
+// so that a named task is not added again, as Task Queue does.
+// The directory must be used by one process, because tasks are indexed in memory.
+type LocalTaskQueue struct {
+	Dir         string
+	Target      string
+	Client      *http.Client
+	Workers     int
+	RetryPolicy RetryPolicy
+
+	mu sync.Mutex
+	// nextRunAt indexes tasks in the directory by name, so that workers don't read every file to find one
+	nextRunAt map[string]time.Time
+	running   map[string]bool
+	seq       int64
+}
+
+func NewLocalTaskQueue(dir, target string, workers int, retryPolicy RetryPolicy) (*LocalTaskQueue, error) {
+	if dir == "" {
+		return nil, errNoLocalTaskQueueDir
+	}
+	return &LocalTaskQueue{
+		Dir:         dir,
+		Target:      strings.TrimSuffix(target, "/"),
+		Client:      &http.Client{Timeout: LOCAL_TASK_QUEUE_TIMEOUT},
+		Workers:     workers,
+		RetryPolicy: retryPolicy,
+		nextRunAt:   make(map[string]time.Time),
+		running:     make(map[string]bool),
+	}, nil
+}
+
+func (q *LocalTaskQueue) Add(ctx context.Context, task *Task, queueName string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name := task.Name
+	if name == "" {
+		q.seq++
+		name = fmt.Sprintf("%d-%d", time.Now().UnixNano(), q.seq)
+	}
+	if _, ok := q.nextRunAt[name]; ok {
+		return ErrTaskAlreadyAdded
+	}
+	if q.hasTombstone(name) {
+		return ErrTaskAlreadyAdded
+	}
+
+	t := &localTask{
+		Name:      name,
+		QueueName: queueName,
+		Path:      task.Path,
+		Payload:   task.Payload,
+		Header:    task.Header,
+		NextRunAt: time.Now().Add(task.Delay),
+	}
+	if err := q.save(t, false); err != nil {
+		return err
+	}
+	q.nextRunAt[name] = t.NextRunAt
+	return nil
+}
+
+// Start loads tasks left in the directory, and starts workers.
+func (q *LocalTaskQueue) Start() error {
+	for _, dir := range []string{localDeadTaskDir, localDoneTaskDir} {
+		if err := os.MkdirAll(filepath.Join(q.Dir, dir), 0755); err != nil {
+			return err
+		}
+	}
+	if err := q.pruneTombstones(time.Now()); err != nil {
+		return err
+	}
+	if err := q.loadIndex(); err != nil {
+		return err
+	}
+	for i := 0; i < q.Workers; i++ {
+		go q.work()
+	}
+	return nil
+}
+
+func (q *LocalTaskQueue) loadIndex() error {
+	files, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), localTaskFileSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), localTaskFileSuffix)
+		task, err := q.load(name)
+		if err != nil {
+			stdlog.Printf("failed to load task %s: %s", name, err)
+			continue
+		}
+		q.nextRunAt[name] = task.NextRunAt
+	}
+	return nil
+}
+
+// Every requests GET to the path periodically in place of App Engine Cron.
+func (q *LocalTaskQueue) Every(path string, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			req, err := http.NewRequest("GET", q.Target+path, nil)
+			if err != nil {
+				stdlog.Printf("failed to create request: %s", err)
+				continue
+			}
+			if _, err := q.do(req); err != nil {
+				stdlog.Printf("failed to request %s: %s", path, err)
+			}
+		}
+	}()
+}
+
+func (q *LocalTaskQueue) work() {
+	for {
+		task := q.claim()
+		if task == nil {
+			time.Sleep(LOCAL_TASK_QUEUE_POLL_INTERVAL)
+			continue
+		}
+		q.run(task)
+
+		q.mu.Lock()
+		delete(q.running, task.Name)
+		q.mu.Unlock()
+	}
+}
+
+// claim returns the runnable task of the earliest NextRunAt which no other worker is running.
+func (q *LocalTaskQueue) claim() *localTask {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name := ""
+	var earliest time.Time
+	for n, nextRunAt := range q.nextRunAt {
+		if q.running[n] || nextRunAt.After(now) {
+			continue
+		}
+		if name == "" || nextRunAt.Before(earliest) {
+			name, earliest = n, nextRunAt
+		}
+	}
+	if name == "" {
+		return nil
+	}
+
+	task, err := q.load(name)
+	if err != nil {
+		stdlog.Printf("failed to load task %s: %s", name, err)
+		delete(q.nextRunAt, name)
+		return nil
+	}
+	q.running[name] = true
+	return task
+}
+
+func (q *LocalTaskQueue) run(task *localTask) {
+	status, err := q.dispatch(task)
+	if err == nil && status >= 200 && status < 300 {
+		q.mu.Lock()
+		delete(q.nextRunAt, task.Name)
+		q.mu.Unlock()
+		if err := q.bury(task.Name, localDoneTaskDir); err != nil {
+			stdlog.Printf("failed to move task %s: %s", task.Name, err)
+		}
+		return
+	}
+
+	task.Attempts++
+	if err != nil {
+		task.LastError = err.Error()
+	} else {
+		task.LastError = fmt.Sprintf("status=%d", status)
+	}
+	if task.Attempts >= q.RetryPolicy.MaxAttempts {
+		stdlog.Printf("task %s failed %d times, give up", task.Name, task.Attempts)
+		q.mu.Lock()
+		delete(q.nextRunAt, task.Name)
+		q.mu.Unlock()
+		if err := q.bury(task.Name, localDeadTaskDir); err != nil {
+			stdlog.Printf("failed to move task %s: %s", task.Name, err)
+		}
+		return
+	}
+
+	task.NextRunAt = time.Now().Add(q.RetryPolicy.Backoff(task.Attempts))
+	if err := q.save(task, true); err != nil {
+		stdlog.Printf("failed to save task %s: %s", task.Name, err)
+	}
+	q.mu.Lock()
+	q.nextRunAt[task.Name] = task.NextRunAt
+	q.mu.Unlock()
+}
+
+func (q *LocalTaskQueue) dispatch(task *localTask) (int, error) {
+	req, err := http.NewRequest("POST", q.Target+task.Path, bytes.NewReader(task.Payload))
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range task.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return q.do(req)
+}
+
+func (q *LocalTaskQueue) do(req *http.Request) (int, error) {
+	req.Header.Set(LOCAL_TASK_TOKEN_HEADER, localTaskToken)
+	resp, err := q.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, nil
+}
+
+func (q *LocalTaskQueue) taskPath(name string) string {
+	return filepath.Join(q.Dir, name+localTaskFileSuffix)
+}
+
+// bury moves the task to the subdirectory, where it's kept as the tombstone of the name.
+// The modification time is of the move, from which the tombstone expires.
+func (q *LocalTaskQueue) bury(name, dir string) error {
+	path := filepath.Join(q.Dir, dir, name+localTaskFileSuffix)
+	if err := os.Rename(q.taskPath(name), path); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+func (q *LocalTaskQueue) hasTombstone(name string) bool {
+	for _, dir := range []string{localDoneTaskDir, localDeadTaskDir} {
+		if _, err := os.Stat(filepath.Join(q.Dir, dir, name+localTaskFileSuffix)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneTombstones removes completed tasks older than LOCAL_TASK_TOMBSTONE_TTL.
+// Dead tasks are kept to be inspected.
+func (q *LocalTaskQueue) pruneTombstones(now time.Time) error {
+	dir := filepath.Join(q.Dir, localDoneTaskDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if now.Sub(file.ModTime()) > LOCAL_TASK_TOMBSTONE_TTL {
+			os.Remove(filepath.Join(dir, file.Name()))
+		}
+	}
+	return nil
+}
+
+func (q *LocalTaskQueue) load(name string) (*localTask, error) {
+	data, err := ioutil.ReadFile(q.taskPath(name))
+	if err != nil {
+		return nil, err
+	}
+	var task localTask
+	if err := json.Unmarshal(data, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// save writes the task to a temporary file first so that a crash doesn't leave a broken task.
+// A new task is linked to its path, which fails if the task exists even if it's added by another process.
+func (q *LocalTaskQueue) save(task *localTask, overwrite bool) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(q.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if overwrite {
+		return os.Rename(tmp.Name(), q.taskPath(task.Name))
+	}
+	if err := os.Link(tmp.Name(), q.taskPath(task.Name)); err != nil {
+		if os.IsExist(err) {
+			return ErrTaskAlreadyAdded
+		}
+		return err
+	}
+	return nil
+}
@@ -1,7 +1,13 @@
 package indexer
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
@@ -10,7 +16,7 @@ import (
 func AuthTaskqueue(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := appengine.NewContext(r)
-		if r.Header.Get("X-AppEngine-QueueName") == "" {
+		if r.Header.Get("X-AppEngine-QueueName") == "" && !IsLocalTask(r) {
 			log.Warningf(ctx, "Request is not from TaskQueue")
 			w.WriteHeader(http.StatusForbidden)
 			return
@@ -18,3 +24,112 @@ func AuthTaskqueue(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+func AuthApiToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		token := os.Getenv("IMPORT_API_TOKEN")
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			log.Warningf(ctx, "Request has no valid API token")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func AuthCron(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Header.Get("X-Appengine-Cron") != "true" && !IsLocalTask(r) {
+			log.Warningf(ctx, "Request is not from Cron")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthInboundApp accepts only requests from the other services of this app, such as the web,
+// by the header which App Engine sets on URL Fetch requests. dev_appserver.py doesn't set it.
+func AuthInboundApp(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Header.Get("X-Appengine-Inbound-Appid") != appengine.AppID(ctx) && !appengine.IsDevAppServer() {
+			log.Warningf(ctx, "Request is not from this app")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// VerifyTaskSignature accepts only task requests signed with the secret,
+// which doesn't rely on the header set by App Engine Task Queue.
+func VerifyTaskSignature(secret []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := appengine.NewContext(r)
+			payload, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				log.Warningf(ctx, "failed to read body: %s", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(payload))
+
+			if err := verifyTaskSignature(secret, r.Method, r.URL.Path, payload, r.Header.Get(TASK_SIGNATURE_HEADER), time.Now()); err != nil {
+				log.Warningf(ctx, "Request has no valid task signature: %s", err)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// VerifyPubSubPush accepts only push requests from Cloud Pub/Sub with a valid OIDC token
+// of the service account.
+func VerifyPubSubPush(audience, serviceAccountEmail string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := appengine.NewContext(r)
+			authz := r.Header.Get("Authorization")
+			if !strings.HasPrefix(authz, "Bearer ") {
+				log.Warningf(ctx, "Request has no bearer token")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			keys, err := googleCertsCache.Keys(ctx)
+			if err != nil {
+				log.Criticalf(ctx, "failed to fetch Google certs: %s", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			token := strings.TrimPrefix(authz, "Bearer ")
+			claims, err := verifyJWT(token, keys)
+			if err == errUnknownSigningKey {
+				// Google may have rotated keys since they are cached
+				if keys, err = googleCertsCache.Refetch(ctx); err != nil {
+					log.Criticalf(ctx, "failed to fetch Google certs: %s", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				claims, err = verifyJWT(token, keys)
+			}
+			if err != nil {
+				log.Warningf(ctx, "invalid token: %s", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if err := claims.Validate(audience, serviceAccountEmail, time.Now()); err != nil {
+				log.Warningf(ctx, "invalid token claims: %s", err)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	MIGRATION_QUEUE              = "migration-queue"
+	DEFAULT_MIGRATION_BATCH_SIZE = 50
+	MIGRATION_RESULTS_PER_PAGE   = 100
+)
+
+var errUnknownMigration = errors.New("unknown migration")
+
+// Migration updates every entity of the kind, such as a backfill of a new property.
+// It runs in batches, each of which is a task adding the task of the next batch with the cursor,
+// so that it isn't bound by the request deadline.
+type Migration struct {
+	Kind      string
+	BatchSize int
+	// Migrate updates the entity and reports whether it's changed.
+	// Changed and failed entities are recorded as results of the run.
+	// It must be idempotent, because a batch may be retried.
+	Migrate func(ctx context.Context, run *MigrationRun, key *datastore.Key) (bool, error)
+	// ValidateParams is optional, which checks params before the run starts
+	ValidateParams func(params []byte) error
+	// Filter is optional, which narrows the entities by a property such as "diagramType ="
+	Filter      string
+	FilterValue interface{}
+}
+
+var migrations = map[string]*Migration{
+	"uml-blobs":          {Kind: "Uml", BatchSize: 20, Migrate: migrateUmlBlobs},
+	"rerender":           {Kind: "Uml", BatchSize: 10, Migrate: rerenderUml},
+	"sanitize-svg":       {Kind: "Uml", BatchSize: 20, Migrate: sanitizeUmlSvg},
+	"optimize-svg":       {Kind: "Uml", BatchSize: 20, Migrate: optimizeUmlSvg},
+	"thumbnails":         {Kind: "Uml", BatchSize: 20, Migrate: makeUmlThumbnails},
+	"reclassify":         {Kind: "Uml", BatchSize: 20, Migrate: reclassifyUml},
+	"reclassify-unknown": {Kind: "Uml", BatchSize: 20, Migrate: reclassifyUnknownUml, Filter: "diagramType =", FilterValue: TypeUnknwon},
+	"compat":             {Kind: "Uml", BatchSize: 10, Migrate: compareUmlRenderings, ValidateParams: validateCompatParams},
+}
+
+type InvalidMigrationParamsError struct {
+	Err error
+}
+
+func (e *InvalidMigrationParamsError) Error() string {
+	return fmt.Sprintf("invalid migration params: %s", e.Err)
+}
+
+// TemporaryMigrationError fails the batch to be retried from the entity, instead of recording the entity as failed,
+// such as when the renderer is unavailable.
+type TemporaryMigrationError struct {
+	Err error
+}
+
+func (e *TemporaryMigrationError) Error() string {
+	return fmt.Sprintf("temporary migration error: %s", e.Err)
+}
+
+type MigrationStatus string
+
+const (
+	MigrationRunning MigrationStatus = "running"
+	MigrationDone    MigrationStatus = "done"
+)
+
+// MigrationRun is the progress of a migration. Failures of entities don't stop the run,
+// and they can be retried by running the migration again.
+type MigrationRun struct {
+	Id        int64           `datastore:"-" json:"id"`
+	Name      string          `datastore:"name" json:"name"`
+	Status    MigrationStatus `datastore:"status" json:"status"`
+	Batches   int             `datastore:"batches,noindex" json:"batches"`
+	Processed int             `datastore:"processed,noindex" json:"processed"`
+	Changed   int             `datastore:"changed,noindex" json:"changed"`
+	Failed    int             `datastore:"failed,noindex" json:"failed"`
+	LastError string          `datastore:"lastError,noindex" json:"lastError,omitempty"`
+	// Params are given when the run is started, which is JSON specific to the migration
+	Params []byte `datastore:"params,noindex" json:"params,omitempty"`
+	// Stats are aggregated by the migration, which is JSON specific to the migration such as SvgSavings
+	Stats []byte `datastore:"stats,noindex" json:"stats,omitempty"`
+	// Cursor is where the next batch starts
+	Cursor    string    `datastore:"cursor,noindex" json:"-"`
+	StartedAt time.Time `datastore:"startedAt" json:"startedAt"`
+	UpdatedAt time.Time `datastore:"updatedAt,noindex" json:"updatedAt"`
+}
+
+type MigrationOutcome string
+
+const (
+	MigrationChanged MigrationOutcome = "changed"
+	MigrationFailed  MigrationOutcome = "failed"
+)
+
+// MigrationResult is a changed or failed entity of a run, whose parent is the MigrationRun.
+type MigrationResult struct {
+	Key       *datastore.Key   `datastore:"key" json:"-"`
+	EntityId  int64            `datastore:"-" json:"entityId"`
+	Outcome   MigrationOutcome `datastore:"outcome" json:"outcome"`
+	Error     string           `datastore:"error,noindex" json:"error,omitempty"`
+	Batch     int              `datastore:"batch" json:"batch"`
+	CreatedAt time.Time        `datastore:"createdAt,noindex" json:"createdAt"`
+}
+
+type MigrationBatchRequestBody struct {
+	RunId  int64  `json:"runId"`
+	Batch  int    `json:"batch"`
+	Cursor string `json:"cursor"`
+}
+
+func StartMigration(ctx context.Context, name string, params []byte) (int64, error) {
+	migration, ok := migrations[name]
+	if !ok {
+		return 0, errUnknownMigration
+	}
+	if migration.ValidateParams != nil {
+		if err := migration.ValidateParams(params); err != nil {
+			return 0, &InvalidMigrationParamsError{err}
+		}
+	}
+
+	now := time.Now()
+	run := &MigrationRun{
+		Name:      name,
+		Status:    MigrationRunning,
+		Params:    params,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "MigrationRun", nil), run)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := addMigrationBatchTask(ctx, name, &MigrationBatchRequestBody{RunId: key.IntID()}); err != nil {
+		return 0, err
+	}
+	return key.IntID(), nil
+}
+
+func FetchMigrationRun(ctx context.Context, runId int64) (*MigrationRun, error) {
+	var run MigrationRun
+	err := datastore.Get(ctx, datastore.NewKey(ctx, "MigrationRun", "", runId, nil), &run)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	run.Id = runId
+	return &run, nil
+}
+
+// FetchMigrationResults returns results of the run, filtered by the outcome if it's not empty.
+func FetchMigrationResults(ctx context.Context, runId int64, outcome MigrationOutcome, cursor string) ([]*MigrationResult, string, error) {
+	runKey := datastore.NewKey(ctx, "MigrationRun", "", runId, nil)
+	q := datastore.NewQuery("MigrationResult").Ancestor(runKey).Limit(MIGRATION_RESULTS_PER_PAGE)
+	if outcome != "" {
+		q = q.Filter("outcome =", outcome)
+	}
+	if cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", errInvalidCursor
+		}
+		q = q.Start(decoded)
+	}
+
+	var results []*MigrationResult
+	iter := q.Run(ctx)
+	for {
+		var result MigrationResult
+		_, err := iter.Next(&result)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		result.EntityId = result.Key.IntID()
+		results = append(results, &result)
+	}
+
+	var nextCursor string
+	if len(results) == MIGRATION_RESULTS_PER_PAGE {
+		if c, err := iter.Cursor(); err == nil {
+			nextCursor = c.String()
+		}
+	}
+	return results, nextCursor, nil
+}
+
+// RunMigrationBatch migrates a batch of entities, and adds the task of the next batch if any.
+func RunMigrationBatch(ctx context.Context, name string, body *MigrationBatchRequestBody) error {
+	migration, ok := migrations[name]
+	if !ok {
+		return errUnknownMigration
+	}
+
+	runKey := datastore.NewKey(ctx, "MigrationRun", "", body.RunId, nil)
+	var run MigrationRun
+	if err := datastore.Get(ctx, runKey, &run); err != nil {
+		return err
+	}
+	run.Id = body.RunId
+	if run.Status == MigrationDone {
+		return nil
+	}
+	if body.Batch < run.Batches {
+		// retry of a finished batch, which may have failed to add the next one
+		log.Infof(ctx, "migration batch is already done: run=%d, batch=%d", body.RunId, body.Batch)
+		return addMigrationBatchTask(ctx, name, &MigrationBatchRequestBody{
+			RunId:  body.RunId,
+			Batch:  run.Batches,
+			Cursor: run.Cursor,
+		})
+	}
+
+	batchSize := migration.BatchSize
+	if batchSize <= 0 {
+		batchSize = DEFAULT_MIGRATION_BATCH_SIZE
+	}
+	q := datastore.NewQuery(migration.Kind).KeysOnly().Limit(batchSize)
+	if migration.Filter != "" {
+		q = q.Filter(migration.Filter, migration.FilterValue)
+	}
+	// the run has the cursor after the entities which a failed attempt of the batch migrated
+	if run.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(run.Cursor)
+		if err != nil {
+			return err
+		}
+		q = q.Start(cursor)
+	}
+
+	iter := q.Run(ctx)
+	var keys []*datastore.Key
+	var cursors []datastore.Cursor
+	for {
+		key, err := iter.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		cursor, err := iter.Cursor()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		cursors = append(cursors, cursor)
+	}
+
+	var resultKeys []*datastore.Key
+	var results []*MigrationResult
+	var temporaryErr *TemporaryMigrationError
+	for i, key := range keys {
+		changed, err := migration.Migrate(ctx, &run, key)
+		if e, ok := err.(*TemporaryMigrationError); ok {
+			log.Warningf(ctx, "failed to migrate %s, retry the batch: %s", key, e)
+			temporaryErr = e
+			if i > 0 {
+				run.Cursor = cursors[i-1].String()
+			}
+			break
+		}
+		run.Processed++
+		result := &MigrationResult{
+			Key:       key,
+			Batch:     body.Batch,
+			CreatedAt: time.Now(),
+		}
+		if err != nil {
+			log.Errorf(ctx, "failed to migrate %s: %s", key, err)
+			run.Failed++
+			run.LastError = fmt.Sprintf("%s: %s", key, err)
+			result.Outcome = MigrationFailed
+			result.Error = err.Error()
+		} else if changed {
+			run.Changed++
+			result.Outcome = MigrationChanged
+		} else {
+			continue
+		}
+		// keyed by the entity so that a retried batch doesn't duplicate results
+		resultKeys = append(resultKeys, datastore.NewKey(ctx, "MigrationResult", key.Encode(), 0, runKey))
+		results = append(results, result)
+	}
+	if len(results) > 0 {
+		if _, err := datastore.PutMulti(ctx, resultKeys, results); err != nil {
+			return err
+		}
+	}
+
+	if temporaryErr != nil {
+		// the progress is saved, so that the retry doesn't migrate the entities again
+		run.UpdatedAt = time.Now()
+		if _, err := datastore.Put(ctx, runKey, &run); err != nil {
+			return err
+		}
+		return temporaryErr
+	}
+
+	run.Batches = body.Batch + 1
+	run.UpdatedAt = time.Now()
+	if len(keys) < batchSize {
+		run.Status = MigrationDone
+	} else {
+		cursor, err := iter.Cursor()
+		if err != nil {
+			return err
+		}
+		run.Cursor = cursor.String()
+	}
+	// the progress is saved first, so that the next batch doesn't see the stale one
+	if _, err := datastore.Put(ctx, runKey, &run); err != nil {
+		return err
+	}
+
+	if run.Status == MigrationDone {
+		log.Infof(ctx, "migration is done: run=%d, processed=%d, changed=%d, failed=%d", body.RunId, run.Processed, run.Changed, run.Failed)
+		return nil
+	}
+	return addMigrationBatchTask(ctx, name, &MigrationBatchRequestBody{
+		RunId:  body.RunId,
+		Batch:  run.Batches,
+		Cursor: run.Cursor,
+	})
+}
+
+func addMigrationBatchTask(ctx context.Context, name string, body *MigrationBatchRequestBody) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	task := &Task{
+		// a retried batch doesn't add the next batch twice
+		Name:    fmt.Sprintf("migration-%d-%d", body.RunId, body.Batch),
+		Path:    fmt.Sprintf("/migrations/%s/batches", name),
+		Payload: payload,
+	}
+	err = taskQueue.Add(ctx, task, MIGRATION_QUEUE)
+	if err == ErrTaskAlreadyAdded {
+		return nil
+	}
+	return err
+}
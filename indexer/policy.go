@@ -0,0 +1,156 @@
+package indexer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	DEFAULT_INCLUSION_POLICY_PATH = "inclusion_policy.json"
+)
+
+type PolicyRule string
+
+const (
+	RuleMinSourceLength   PolicyRule = "minSourceLength"
+	RuleMaxSourceBytes    PolicyRule = "maxSourceBytes"
+	RuleMinLines          PolicyRule = "minLines"
+	RuleBlocklist         PolicyRule = "blocklist"
+	RuleMinElements       PolicyRule = "minElements"
+	RuleMaxElements       PolicyRule = "maxElements"
+	RuleDiagramTypes      PolicyRule = "diagramTypes"
+	RuleMaxRenderedPixels PolicyRule = "maxRenderedPixels"
+)
+
+// InclusionPolicy decides which sources are indexed. Zero value of each limit means unlimited.
+type InclusionPolicy struct {
+	MinSourceLength   int              `json:"minSourceLength"`
+	MaxSourceBytes    int              `json:"maxSourceBytes"`
+	MinLines          int              `json:"minLines"`
+	MinElements       int              `json:"minElements"`
+	MaxElements       int              `json:"maxElements"`
+	MaxRenderedPixels int              `json:"maxRenderedPixels"`
+	DiagramTypes      []DiagramType    `json:"diagramTypes"`
+	Blocklist         []BlocklistEntry `json:"blocklist"`
+}
+
+// BlocklistEntry is SHA256 of a normalized source, such as an example in PlantUML documentation.
+// Description tells what the source is, because the hash doesn't.
+type BlocklistEntry struct {
+	SHA256      string `json:"sha256"`
+	Description string `json:"description"`
+}
+
+type PolicyRejection struct {
+	Rule   PolicyRule `json:"rule"`
+	Reason string     `json:"reason"`
+}
+
+func (r *PolicyRejection) Error() string {
+	return fmt.Sprintf("%s: %s", r.Rule, r.Reason)
+}
+
+var DefaultInclusionPolicy = &InclusionPolicy{
+	MinSourceLength: 50,
+}
+
+// LoadInclusionPolicy reads the policy from INCLUSION_POLICY_PATH,
+// or returns the default policy if the file doesn't exist.
+func LoadInclusionPolicy() (*InclusionPolicy, error) {
+	path := os.Getenv("INCLUSION_POLICY_PATH")
+	if path == "" {
+		path = DEFAULT_INCLUSION_POLICY_PATH
+	}
+	return loadInclusionPolicyFile(path)
+}
+
+func loadInclusionPolicyFile(path string) (*InclusionPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return DefaultInclusionPolicy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var policy InclusionPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	return &policy, nil
+}
+
+// normalizeSource ignores indentation, blank lines and the difference of line endings,
+// so that a slightly modified copy of a blocklisted source is also rejected.
+func normalizeSource(source string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.Replace(source, "\r\n", "\n", -1), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func normalizedSourceHash(source string) string {
+	hash := sha256.Sum256([]byte(normalizeSource(source)))
+	return hex.EncodeToString(hash[:])
+}
+
+// CheckSource evaluates the rules which need only the source.
+func (p *InclusionPolicy) CheckSource(source string) *PolicyRejection {
+	if p.MinSourceLength > 0 && len(source) < p.MinSourceLength {
+		return &PolicyRejection{RuleMinSourceLength, fmt.Sprintf("length %d is under %d", len(source), p.MinSourceLength)}
+	}
+	if p.MaxSourceBytes > 0 && len(source) > p.MaxSourceBytes {
+		return &PolicyRejection{RuleMaxSourceBytes, fmt.Sprintf("%d bytes exceeds %d", len(source), p.MaxSourceBytes)}
+	}
+	if lines := strings.Count(normalizeSource(source), "\n") + 1; p.MinLines > 0 && lines < p.MinLines {
+		return &PolicyRejection{RuleMinLines, fmt.Sprintf("%d lines is under %d", lines, p.MinLines)}
+	}
+	if len(p.Blocklist) > 0 {
+		hash := normalizedSourceHash(source)
+		for _, blocked := range p.Blocklist {
+			if hash == blocked.SHA256 {
+				return &PolicyRejection{RuleBlocklist, fmt.Sprintf("known example %s: %s", hash, blocked.Description)}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckDiagram evaluates the rules which need the syntax check result.
+// Element count is negative when the syntax checker doesn't report it.
+func (p *InclusionPolicy) CheckDiagram(typ DiagramType, elements int) *PolicyRejection {
+	if elements >= 0 {
+		if p.MinElements > 0 && elements < p.MinElements {
+			return &PolicyRejection{RuleMinElements, fmt.Sprintf("%d elements is under %d", elements, p.MinElements)}
+		}
+		if p.MaxElements > 0 && elements > p.MaxElements {
+			return &PolicyRejection{RuleMaxElements, fmt.Sprintf("%d elements exceeds %d", elements, p.MaxElements)}
+		}
+	}
+	if len(p.DiagramTypes) > 0 {
+		for _, t := range p.DiagramTypes {
+			if t == typ {
+				return nil
+			}
+		}
+		return &PolicyRejection{RuleDiagramTypes, fmt.Sprintf("diagram type %s is not allowed", typ)}
+	}
+	return nil
+}
+
+// CheckRendered evaluates the rules which need the rendered image.
+func (p *InclusionPolicy) CheckRendered(width, height int) *PolicyRejection {
+	if p.MaxRenderedPixels > 0 && width*height > p.MaxRenderedPixels {
+		return &PolicyRejection{RuleMaxRenderedPixels, fmt.Sprintf("%dx%d pixels exceeds %d", width, height, p.MaxRenderedPixels)}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package indexer
+
+import (
+	"testing"
+)
+
+func TestInclusionPolicyCheckSource(t *testing.T) {
+	policy := &InclusionPolicy{
+		MinSourceLength: 30,
+		MaxSourceBytes:  200,
+		MinLines:        4,
+		Blocklist:       []BlocklistEntry{{SHA256: normalizedSourceHash("@startuml\nAlice -> Bob: hello\nBob -> Alice: hi\n@enduml")}},
+	}
+
+	var tests = []struct {
+		source   string
+		expected PolicyRule
+	}{
+		{"@startuml\nA -> B\n@enduml", RuleMinSourceLength},
+		{"@startuml\n" + string(make([]byte, 200)) + "\n@enduml", RuleMaxSourceBytes},
+		{"@startuml\nAlice -> Bob: hello world\n@enduml", RuleMinLines},
+		{"@startuml\n  Alice -> Bob: hello\r\n\r\n  Bob -> Alice: hi\r\n@enduml", RuleBlocklist},
+		{"@startuml\nAlice -> Bob: hello\nBob -> Alice: hello\n@enduml", ""},
+	}
+
+	for _, test := range tests {
+		rejection := policy.CheckSource(test.source)
+		if test.expected == "" {
+			if rejection != nil {
+				t.Errorf("source should be accepted: source=%q, rejection=%s", test.source, rejection)
+			}
+			continue
+		}
+		if rejection == nil || rejection.Rule != test.expected {
+			t.Errorf("not expected rejection: source=%q, got=%v, expected=%s", test.source, rejection, test.expected)
+		}
+	}
+}
+
+func TestInclusionPolicyCheckDiagram(t *testing.T) {
+	policy := &InclusionPolicy{
+		MinElements:  2,
+		MaxElements:  10,
+		DiagramTypes: []DiagramType{TypeSequence, TypeClass},
+	}
+
+	var tests = []struct {
+		typ      DiagramType
+		elements int
+		expected PolicyRule
+	}{
+		{TypeSequence, 1, RuleMinElements},
+		{TypeSequence, 11, RuleMaxElements},
+		{TypeState, 3, RuleDiagramTypes},
+		{TypeClass, 3, ""},
+		{TypeClass, -1, ""},
+	}
+
+	for _, test := range tests {
+		rejection := policy.CheckDiagram(test.typ, test.elements)
+		if (rejection == nil && test.expected != "") || (rejection != nil && rejection.Rule != test.expected) {
+			t.Errorf("not expected rejection: type=%s, elements=%d, got=%v, expected=%s", test.typ, test.elements, rejection, test.expected)
+		}
+	}
+
+	if rejection := (&InclusionPolicy{MaxRenderedPixels: 100}).CheckRendered(20, 10); rejection == nil || rejection.Rule != RuleMaxRenderedPixels {
+		t.Errorf("too large image should be rejected: got=%v", rejection)
+	}
+}
+
+func TestLoadInclusionPolicy(t *testing.T) {
+	policy, err := loadInclusionPolicyFile(DEFAULT_INCLUSION_POLICY_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// examples of PlantUML documentation in the blocklist, in the same order
+	examples := []string{
+		"@startuml\nAlice -> Bob: Authentication Request\nBob --> Alice: Authentication Response\n@enduml",
+		"@startuml\nAlice -> Bob: Authentication Request\nBob --> Alice: Authentication Response\n\nAlice -> Bob: Another authentication Request\nAlice <-- Bob: Another authentication Response\n@enduml",
+		"@startuml\nObject <|-- ArrayList\n\nObject : equals()\nArrayList : Object[] elementData\nArrayList : size()\n@enduml",
+		"@startuml\nstart\n:Hello world;\n:This is defined on\nseveral **lines**;\nstop\n@enduml",
+	}
+	if len(policy.Blocklist) != len(examples) {
+		t.Fatalf("not expected blocklist: got=%d, expected=%d", len(policy.Blocklist), len(examples))
+	}
+	for i, example := range examples {
+		if policy.Blocklist[i].SHA256 != normalizedSourceHash(example) || policy.Blocklist[i].Description == "" {
+			t.Errorf("blocklist entry doesn't match the example: entry=%#v, example=%q", policy.Blocklist[i], example)
+		}
+		if rejection := policy.CheckSource(example); rejection == nil || rejection.Rule != RuleBlocklist {
+			t.Errorf("example of PlantUML documentation should be rejected: got=%v", rejection)
+		}
+	}
+
+	if got, err := loadInclusionPolicyFile("not_found.json"); err != nil || got != DefaultInclusionPolicy {
+		t.Errorf("default policy should be returned without the file: got=%v, err=%v", got, err)
+	}
+}
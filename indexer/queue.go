@@ -0,0 +1,122 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	stdlog "log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine/taskqueue"
+)
+
+var ErrTaskAlreadyAdded = errors.New("task already added")
+
+// Task is a POST request with JSON payload which is executed asynchronously.
+type Task struct {
+	// Name is optional. A task with the same name as the existing one is rejected.
+	Name    string
+	Path    string
+	Payload []byte
+	Header  http.Header
+	Delay   time.Duration
+}
+
+type TaskQueue interface {
+	Add(ctx context.Context, task *Task, queueName string) error
+}
+
+// RetryPolicy is used by the local task queue.
+// Retries of App Engine Task Queue are configured in queue.yaml.
+type RetryPolicy struct {
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	MinBackoff:  10 * time.Second,
+	MaxBackoff:  10 * time.Minute,
+}
+
+// Backoff returns the delay before the next attempt, which doubles per attempt.
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	backoff := p.MinBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+// JitteredBackoff returns a random delay between the half and the whole of Backoff,
+// so that clients failed at the same time don't retry at the same time.
+func (p RetryPolicy) JitteredBackoff(attempts int) time.Duration {
+	backoff := p.Backoff(attempts)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// taskQueue is initialized in init() by TASK_QUEUE_BACKEND
+var taskQueue TaskQueue = &AppEngineTaskQueue{}
+
+func newTaskQueueFromEnv() TaskQueue {
+	q := newTaskQueueBackendFromEnv()
+	if secret := os.Getenv("TASK_SIGNING_SECRET"); secret != "" {
+		return &signingTaskQueue{TaskQueue: q, secret: []byte(secret)}
+	}
+	return q
+}
+
+func newTaskQueueBackendFromEnv() TaskQueue {
+	switch os.Getenv("TASK_QUEUE_BACKEND") {
+	case "local":
+		workers, _ := strconv.Atoi(os.Getenv("LOCAL_TASK_QUEUE_WORKERS"))
+		if workers <= 0 {
+			workers = 1
+		}
+		target := os.Getenv("LOCAL_TASK_QUEUE_TARGET")
+		if target == "" {
+			stdlog.Fatalf("LOCAL_TASK_QUEUE_TARGET is not set")
+		}
+		q, err := NewLocalTaskQueue(os.Getenv("LOCAL_TASK_QUEUE_DIR"), target, workers, defaultRetryPolicy)
+		if err != nil {
+			stdlog.Fatalf("failed to create local task queue: %s", err)
+		}
+		if err := q.Start(); err != nil {
+			stdlog.Fatalf("failed to start local task queue: %s", err)
+		}
+		q.Every("/scheduler/tick", SCHEDULER_TICK_INTERVAL)
+		return q
+	default:
+		return &AppEngineTaskQueue{}
+	}
+}
+
+type AppEngineTaskQueue struct{}
+
+func (q *AppEngineTaskQueue) Add(ctx context.Context, task *Task, queueName string) error {
+	header := make(http.Header)
+	for k, v := range task.Header {
+		header[k] = v
+	}
+	header.Set("Content-Type", "application/json")
+
+	_, err := taskqueue.Add(ctx, &taskqueue.Task{
+		Name:    task.Name,
+		Path:    task.Path,
+		Payload: task.Payload,
+		Header:  header,
+		Method:  "POST",
+		Delay:   task.Delay,
+	}, queueName)
+	if err == taskqueue.ErrTaskAlreadyAdded {
+		return ErrTaskAlreadyAdded
+	}
+	return err
+}
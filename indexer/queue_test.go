@@ -0,0 +1,142 @@
+package indexer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	var tests = []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{9, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		if got := policy.Backoff(test.attempts); got != test.expected {
+			t.Errorf("not expected backoff: attempts=%d, got=%s, expected=%s", test.attempts, got, test.expected)
+		}
+	}
+}
+
+func TestRetryPolicyJitteredBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	for i := 0; i < 100; i++ {
+		got := policy.JitteredBackoff(2)
+		if got < time.Second || got > 2*time.Second {
+			t.Errorf("jittered backoff is out of range: %s", got)
+		}
+	}
+}
+
+func TestLocalTaskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local_task_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsLocalTask(r) {
+			t.Errorf("request is not marked as local task")
+		}
+		calls++
+		if calls < 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	if _, err := NewLocalTaskQueue("", server.URL, 1, defaultRetryPolicy); err != errNoLocalTaskQueueDir {
+		t.Errorf("empty directory should be rejected: err=%v", err)
+	}
+	q, err := NewLocalTaskQueue(dir, server.URL, 1, RetryPolicy{MaxAttempts: 3, MinBackoff: 0, MaxBackoff: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"/dead", "/done"} {
+		if err := os.MkdirAll(dir+sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	if err := q.Add(ctx, &Task{Name: "task1", Path: "/indexes"}, INDEX_CREATE_QUEUE); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Add(ctx, &Task{Name: "task1", Path: "/indexes"}, INDEX_CREATE_QUEUE); err != ErrTaskAlreadyAdded {
+		t.Errorf("duplicated task should be rejected: err=%v", err)
+	}
+	// a task file added by another queue of the directory
+	other, _ := NewLocalTaskQueue(dir, server.URL, 1, defaultRetryPolicy)
+	if err := other.Add(ctx, &Task{Name: "task1", Path: "/indexes"}, INDEX_CREATE_QUEUE); err != ErrTaskAlreadyAdded {
+		t.Errorf("existing task file should be rejected: err=%v", err)
+	}
+	if err := q.Add(ctx, &Task{Name: "task2", Path: "/indexes", Delay: time.Hour}, INDEX_CREATE_QUEUE); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1st attempt fails, and 2nd attempt succeeds
+	for i := 0; i < 2; i++ {
+		task := q.claim()
+		if task == nil || task.Name != "task1" {
+			t.Fatalf("task should be claimed: attempt=%d, task=%#v", i+1, task)
+		}
+		q.run(task)
+		delete(q.running, task.Name)
+	}
+	if calls != 2 {
+		t.Errorf("not expected calls: got=%d", calls)
+	}
+	if task := q.claim(); task != nil {
+		t.Errorf("completed and delayed tasks should not be claimed: %#v", task)
+	}
+	// the name of a completed task is kept
+	if err := q.Add(ctx, &Task{Name: "task1", Path: "/indexes"}, INDEX_CREATE_QUEUE); err != ErrTaskAlreadyAdded {
+		t.Errorf("completed task should be rejected: err=%v", err)
+	}
+	if err := q.pruneTombstones(time.Now().Add(LOCAL_TASK_TOMBSTONE_TTL + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if q.hasTombstone("task1") {
+		t.Errorf("expired tombstone should be removed")
+	}
+
+	// tasks left in the directory are loaded
+	restarted, _ := NewLocalTaskQueue(dir, server.URL, 1, defaultRetryPolicy)
+	if err := restarted.loadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.nextRunAt["task2"]; !ok || len(restarted.nextRunAt) != 1 {
+		t.Errorf("not expected tasks: got=%#v", restarted.nextRunAt)
+	}
+}
+
+func TestIsLocalTask(t *testing.T) {
+	req := httptest.NewRequest("POST", "/indexes", nil)
+	if IsLocalTask(req) {
+		t.Errorf("request without the token should not be a local task")
+	}
+	req.Header.Set(LOCAL_TASK_TOKEN_HEADER, "guessed")
+	if IsLocalTask(req) {
+		t.Errorf("request with a wrong token should not be a local task")
+	}
+	req.Header.Set(LOCAL_TASK_TOKEN_HEADER, localTaskToken)
+	if !IsLocalTask(req) {
+		t.Errorf("request with the token should be a local task")
+	}
+}
@@ -0,0 +1,75 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/log"
+)
+
+var errRendererUnavailable = errors.New("renderer is unavailable")
+
+// RenderTimeoutError is returned when rendering a format exceeds its deadline,
+// which is likely caused by the source rather than the renderer.
+type RenderTimeoutError struct {
+	Format   RenderFormat
+	Deadline time.Duration
+}
+
+func (e *RenderTimeoutError) Error() string {
+	return fmt.Sprintf("rendering %s exceeded %s", e.Format, e.Deadline)
+}
+
+// renderDeadlines bound each format so that a pathological diagram doesn't hang the task.
+var renderDeadlines = map[RenderFormat]time.Duration{
+	FormatSvg:     30 * time.Second,
+	FormatPng:     30 * time.Second,
+	FormatAscii:   15 * time.Second,
+	FormatUnicode: 15 * time.Second,
+	FormatPdf:     60 * time.Second,
+	FormatEps:     30 * time.Second,
+	FormatLatex:   30 * time.Second,
+}
+
+var renderRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	MinBackoff:  500 * time.Millisecond,
+	MaxBackoff:  4 * time.Second,
+}
+
+// renderWithRetry retries transient errors with jittered backoff.
+// Diagram errors and exceeding the deadline aren't retried, because they're likely to happen again for the same source.
+func renderWithRetry(ctx context.Context, renderer Renderer, source string, format RenderFormat) ([]byte, error) {
+	deadline := renderDeadlines[format]
+	for attempts := 1; ; attempts++ {
+		renderCtx, cancel := context.WithTimeout(ctx, deadline)
+		data, err := renderer.Render(renderCtx, source, format)
+		timedOut := renderCtx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if timedOut {
+			return nil, &RenderTimeoutError{format, deadline}
+		}
+		if isDiagramError(err) {
+			return nil, err
+		}
+		if attempts >= renderRetryPolicy.MaxAttempts {
+			return nil, err
+		}
+
+		backoff := renderRetryPolicy.JitteredBackoff(attempts)
+		log.Warningf(ctx, "failed to render %s, retry in %s: %s", format, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package indexer
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	LOCAL_RENDER_CACHE_BYTES = 16 << 20
+	// memcache rejects items larger than 1MB
+	MAX_SHARED_RENDER_CACHE_ITEM_BYTES = 1000 << 10
+	RENDER_CACHE_KEY_PREFIX            = "render:"
+)
+
+// localRenderCache is shared among requests of the instance.
+var localRenderCache = NewLRUCache(LOCAL_RENDER_CACHE_BYTES)
+
+var renderCacheStats RenderCacheStats
+
+type RenderCacheStats struct {
+	LocalHits  int64 `json:"localHits"`
+	SharedHits int64 `json:"sharedHits"`
+	Misses     int64 `json:"misses"`
+}
+
+type RenderCacheStatus struct {
+	RenderCacheStats
+	LocalEntries int `json:"localEntries"`
+	LocalBytes   int `json:"localBytes"`
+}
+
+func FetchRenderCacheStatus() *RenderCacheStatus {
+	entries, bytes := localRenderCache.Size()
+	return &RenderCacheStatus{
+		RenderCacheStats: RenderCacheStats{
+			LocalHits:  atomic.LoadInt64(&renderCacheStats.LocalHits),
+			SharedHits: atomic.LoadInt64(&renderCacheStats.SharedHits),
+			Misses:     atomic.LoadInt64(&renderCacheStats.Misses),
+		},
+		LocalEntries: entries,
+		LocalBytes:   bytes,
+	}
+}
+
+// renderCacheKey identifies an output. Only line endings of the source are normalized,
+// because spaces and blank lines can change the output, such as in notes and preformatted text.
+// The renderer is a part of the key, because backends of the same version are compared by the compat migration.
+func renderCacheKey(source string, format RenderFormat, renderer, version, theme string) string {
+	sourceHash := sha256.Sum256([]byte(strings.Replace(source, "\r\n", "\n", -1)))
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s\n%s\n%s", hex.EncodeToString(sourceHash[:]), format, renderer, version, theme)))
+	return RENDER_CACHE_KEY_PREFIX + hex.EncodeToString(hash[:])
+}
+
+// RenderCacheTier is a shared tier of the render cache.
+type RenderCacheTier interface {
+	Get(ctx context.Context, key string) ([]byte, bool)
+	Set(ctx context.Context, key string, data []byte)
+}
+
+type memcacheRenderCacheTier struct{}
+
+func (t memcacheRenderCacheTier) Get(ctx context.Context, key string) ([]byte, bool) {
+	item, err := memcache.Get(ctx, key)
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Warningf(ctx, "failed to get render cache: %s", err)
+		}
+		return nil, false
+	}
+	return item.Value, true
+}
+
+func (t memcacheRenderCacheTier) Set(ctx context.Context, key string, data []byte) {
+	if len(data) > MAX_SHARED_RENDER_CACHE_ITEM_BYTES {
+		return
+	}
+	if err := memcache.Set(ctx, &memcache.Item{Key: key, Value: data}); err != nil {
+		log.Warningf(ctx, "failed to set render cache: %s", err)
+	}
+}
+
+// CachingRenderer looks up the local and the shared tier before rendering.
+// Outputs are keyed by the version of the renderer, so that an upgrade doesn't serve stale ones.
+type CachingRenderer struct {
+	Renderer Renderer
+	// Name identifies the renderer to detect its version and to key its outputs
+	Name string
+	// Theme is the one which the renderer is configured with, other than `!theme` in the source
+	Theme  string
+	Local  *LRUCache
+	Shared RenderCacheTier
+}
+
+func NewCachingRenderer(renderer Renderer, name, theme string) *CachingRenderer {
+	return &CachingRenderer{
+		Renderer: renderer,
+		Name:     name,
+		Theme:    theme,
+		Local:    localRenderCache,
+		Shared:   memcacheRenderCacheTier{},
+	}
+}
+
+func (r *CachingRenderer) Render(ctx context.Context, source string, format RenderFormat) ([]byte, error) {
+	version, err := rendererVersions.Get(ctx, r.Name, r.Renderer)
+	if err != nil {
+		// the output can't be keyed without the version
+		log.Warningf(ctx, "failed to detect renderer version, bypass cache: %s", err)
+		return r.Renderer.Render(ctx, source, format)
+	}
+
+	key := renderCacheKey(source, format, r.Name, version, r.Theme)
+	if data, ok := r.Local.Get(key); ok {
+		atomic.AddInt64(&renderCacheStats.LocalHits, 1)
+		return data, nil
+	}
+	if r.Shared != nil {
+		if data, ok := r.Shared.Get(ctx, key); ok {
+			atomic.AddInt64(&renderCacheStats.SharedHits, 1)
+			r.Local.Set(key, data)
+			return data, nil
+		}
+	}
+	atomic.AddInt64(&renderCacheStats.Misses, 1)
+
+	data, err := r.Renderer.Render(ctx, source, format)
+	if err != nil {
+		return nil, err
+	}
+	r.Local.Set(key, data)
+	if r.Shared != nil {
+		r.Shared.Set(ctx, key, data)
+	}
+	return data, nil
+}
+
+// LRUCache is an in-memory cache bounded by the total bytes of values.
+type LRUCache struct {
+	MaxBytes int
+
+	mu      sync.Mutex
+	bytes   int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	data []byte
+}
+
+func NewLRUCache(maxBytes int) *LRUCache {
+	return &LRUCache{
+		MaxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).data, true
+}
+
+// Set evicts the least recently used values until the new one fits.
+// A value larger than the cache itself is not stored.
+func (c *LRUCache) Set(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(data) > c.MaxBytes {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+	for c.bytes+len(data) > c.MaxBytes {
+		c.removeElement(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, data: data})
+	c.bytes += len(data)
+}
+
+// Size returns the number of entries and their total bytes.
+func (c *LRUCache) Size() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries), c.bytes
+}
+
+func (c *LRUCache) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*lruEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= len(entry.data)
+}
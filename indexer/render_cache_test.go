@@ -0,0 +1,139 @@
+package indexer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	cache := NewLRUCache(10)
+
+	cache.Set("a", []byte("aaaa"))
+	cache.Set("b", []byte("bbbb"))
+	if _, ok := cache.Get("a"); !ok {
+		t.Errorf("a must be cached")
+	}
+
+	// b is evicted, because a is used more recently
+	cache.Set("c", []byte("cccc"))
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("b must be evicted")
+	}
+	if entries, bytes := cache.Size(); entries != 2 || bytes != 8 {
+		t.Errorf("unexpected size: entries=%d, bytes=%d", entries, bytes)
+	}
+
+	cache.Set("d", []byte("too large value"))
+	if _, ok := cache.Get("d"); ok {
+		t.Errorf("a value larger than the cache must not be stored")
+	}
+
+	cache.Set("a", []byte("a"))
+	if data, _ := cache.Get("a"); string(data) != "a" {
+		t.Errorf("a must be replaced: %s", data)
+	}
+	if _, bytes := cache.Size(); bytes != 5 {
+		t.Errorf("unexpected bytes: %d", bytes)
+	}
+}
+
+type countingRenderer struct {
+	version string
+	calls   int
+}
+
+func (r *countingRenderer) Render(ctx context.Context, source string, format RenderFormat) ([]byte, error) {
+	if source == versionDiagramSource {
+		return []byte("PlantUML version " + r.version + " (Sun Jan 01 00:00:00 UTC 2023)"), nil
+	}
+	r.calls++
+	return []byte(source), nil
+}
+
+func TestCachingRenderer(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingRenderer{version: "1.2023.10"}
+	renderer := &CachingRenderer{
+		Renderer: backend,
+		Name:     "TestCachingRenderer",
+		Local:    NewLRUCache(1 << 10),
+	}
+
+	source := "@startuml\nBob -> Alice : hello\n@enduml"
+	renderer.Render(ctx, source, FormatSvg)
+	renderer.Render(ctx, "@startuml\r\nBob -> Alice : hello\r\n@enduml", FormatSvg)
+	if backend.calls != 1 {
+		t.Errorf("source of other line endings must hit the cache: calls=%d", backend.calls)
+	}
+	renderer.Render(ctx, "@startuml\n  Bob -> Alice : hello\n\n@enduml", FormatSvg)
+	if backend.calls != 2 {
+		t.Errorf("source of other spaces must miss the cache: calls=%d", backend.calls)
+	}
+
+	renderer.Render(ctx, source, FormatPng)
+	if backend.calls != 3 {
+		t.Errorf("another format must miss the cache: calls=%d", backend.calls)
+	}
+
+	server := "plantuml-server http://localhost:8080"
+	if renderCacheKey(source, FormatSvg, server, "1.2023.10", "") == renderCacheKey(source, FormatSvg, server, "1.2023.11", "") {
+		t.Errorf("keys of different versions must differ")
+	}
+	if renderCacheKey(source, FormatSvg, server, "1.2023.10", "") == renderCacheKey(source, FormatSvg, server, "1.2023.10", "cerulean") {
+		t.Errorf("keys of different themes must differ")
+	}
+	if renderCacheKey(source, FormatSvg, server, "1.2023.10", "") == renderCacheKey(source, FormatSvg, "kroki http://localhost:8000", "1.2023.10", "") {
+		t.Errorf("keys of different renderers must differ")
+	}
+}
+
+func TestParsePlantUMLVersion(t *testing.T) {
+	version, err := parsePlantUMLVersion("PlantUML version 1.2018.13 (Mon Nov 26 18:11:51 CET 2018)\n(GPL source distribution)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.2018.13" {
+		t.Errorf("unexpected version: %s", version)
+	}
+
+	if _, err := parsePlantUMLVersion("Syntax Error?"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+type slowVersionRenderer struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (r *slowVersionRenderer) Render(ctx context.Context, source string, format RenderFormat) ([]byte, error) {
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	return []byte("PlantUML version 1.2023.10"), nil
+}
+
+func TestRendererVersionCache(t *testing.T) {
+	ctx := context.Background()
+	cache := newRendererVersionCache()
+	renderer := &slowVersionRenderer{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if version, err := cache.Get(ctx, "test", renderer); err != nil || version != "1.2023.10" {
+				t.Errorf("not expected version: got=%s, err=%v", version, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if renderer.calls != 1 {
+		t.Errorf("concurrent detections must be merged: calls=%d", renderer.calls)
+	}
+}
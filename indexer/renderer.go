@@ -2,100 +2,188 @@ package indexer
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
+	"os"
+	"strconv"
 	"strings"
 
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/urlfetch"
 )
 
-type Renderer struct {
-	BaseUrl string
-	ctx     context.Context
+type RenderFormat string
+
+// SVG, PNG and ASCII are rendered at indexing time.
+// The others are rendered by the web on the first download.
+const (
+	FormatSvg     RenderFormat = "svg"
+	FormatPng     RenderFormat = "png"
+	FormatAscii   RenderFormat = "txt"
+	FormatUnicode RenderFormat = "utxt"
+	FormatPdf     RenderFormat = "pdf"
+	FormatEps     RenderFormat = "eps"
+	FormatLatex   RenderFormat = "latex"
+)
+
+const (
+	BackendPlantUMLServer = "plantuml-server"
+	BackendPlantUMLJar    = "jar"
+	BackendKroki          = "kroki"
+)
+
+const (
+	PLANTUML_DIAGRAM_ERROR_HEADER      = "X-PlantUML-Diagram-Error"
+	PLANTUML_DIAGRAM_ERROR_LINE_HEADER = "X-PlantUML-Diagram-Error-Line"
+	MAX_RENDER_ERROR_MESSAGE_LENGTH    = 200
+)
+
+var errUnknownRendererBackend = errors.New("unknown renderer backend")
+
+// RenderError is returned when the renderer responds with an error instead of the diagram.
+type RenderError struct {
+	// StatusCode is the HTTP status, or 0 for a local renderer
+	StatusCode int
+	Message    string
+	// Line is the line number of the error in the source, or 0 if unknown
+	Line int
 }
 
-func NewRenderer(ctx context.Context, baseUrl string) *Renderer {
-	return &Renderer{
-		BaseUrl: baseUrl,
-		ctx:     ctx,
+func (e *RenderError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("render error at line %d: %s", e.Line, e.Message)
 	}
+	return fmt.Sprintf("render error: %s", e.Message)
 }
 
-func (r *Renderer) RenderSvg(source string) (string, error) {
-	umlId, err := r.getUmlId(source)
-	if err != nil {
-		return "", err
+// Temporary reports whether the error is of the renderer, not of the diagram.
+// Only the diagram error headers, which are normalized to 400, a 400 and errors of a local renderer
+// are of the diagram. The other statuses such as 408 and 429 are worth retrying.
+func (e *RenderError) Temporary() bool {
+	return e.StatusCode != 0 && e.StatusCode != http.StatusBadRequest
+}
+
+// isDiagramError reports whether the source can't be rendered, so that it should be rejected
+// instead of failing the task.
+func isDiagramError(err error) bool {
+	renderErr, ok := err.(*RenderError)
+	return ok && !renderErr.Temporary()
+}
+
+// checkRenderResponse returns RenderError for an error status or the diagram error headers.
+// plantuml-server responds an image of the error message, so the body is used only if it's text.
+func checkRenderResponse(resp *http.Response, body []byte) error {
+	message := resp.Header.Get(PLANTUML_DIAGRAM_ERROR_HEADER)
+	if resp.StatusCode == http.StatusOK && message == "" {
+		return nil
 	}
 
-	svgBytes, err := r.doRequest("/svg/" + umlId)
-	if err != nil {
-		return "", err
+	if message == "" && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		message = strings.TrimSpace(string(body))
+		if len(message) > MAX_RENDER_ERROR_MESSAGE_LENGTH {
+			message = message[:MAX_RENDER_ERROR_MESSAGE_LENGTH]
+		}
 	}
-	return string(svgBytes), err
-}
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+	line, _ := strconv.Atoi(resp.Header.Get(PLANTUML_DIAGRAM_ERROR_LINE_HEADER))
 
-func (r *Renderer) RenderPng(source string) ([]byte, error) {
-	umlId, err := r.getUmlId(source)
-	if err != nil {
-		return nil, err
+	statusCode := resp.StatusCode
+	if resp.Header.Get(PLANTUML_DIAGRAM_ERROR_HEADER) != "" {
+		// some versions of plantuml-server respond the error image with 200
+		statusCode = http.StatusBadRequest
 	}
+	return &RenderError{
+		StatusCode: statusCode,
+		Message:    message,
+		Line:       line,
+	}
+}
 
-	return r.doRequest("/png/" + umlId)
+// Renderer renders the source in the format. The deadline of the context bounds each rendering.
+type Renderer interface {
+	Render(ctx context.Context, source string, format RenderFormat) ([]byte, error)
 }
 
-func (r *Renderer) RenderAscii(source string) (string, error) {
-	umlId, err := r.getUmlId(source)
-	if err != nil {
-		return "", err
+// NewRendererFromEnv returns the renderer of the backend behind the render cache.
+// If the backend is empty, RENDERER_BACKEND is used.
+func NewRendererFromEnv(backend string) (Renderer, error) {
+	if backend == "" {
+		backend = os.Getenv("RENDERER_BACKEND")
 	}
 
-	asciiBytes, err := r.doRequest("/txt/" + umlId)
-	if err != nil {
-		return "", err
+	var location string
+	switch backend {
+	case "", BackendPlantUMLServer:
+		location = os.Getenv("RENDERER_BASE_URL")
+	case BackendPlantUMLJar:
+		location = os.Getenv("PLANTUML_JAR_PATH")
+	case BackendKroki:
+		location = os.Getenv("KROKI_BASE_URL")
 	}
-	return string(asciiBytes), err
+	return NewRenderer(backend, location, os.Getenv("RENDERER_THEME"))
 }
 
-func (r *Renderer) getUmlId(source string) (string, error) {
-	values := url.Values{}
-	values.Add("text", source)
-	req, _ := http.NewRequest("POST", r.BaseUrl+"/form", strings.NewReader(values.Encode()))
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	client := urlfetch.Client(r.ctx)
-	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		// no follow redirect
-		return http.ErrUseLastResponse
+// NewRenderer returns the renderer of the backend behind the render cache.
+// The location is the base URL, or the path of plantuml.jar.
+func NewRenderer(backend, location, theme string) (Renderer, error) {
+	var renderer Renderer
+	switch backend {
+	case "", BackendPlantUMLServer:
+		renderer = NewPlantUMLServerRenderer(location)
+	case BackendPlantUMLJar:
+		poolSize, _ := strconv.Atoi(os.Getenv("PLANTUML_JAR_POOL_SIZE"))
+		renderer = sharedPlantUMLJarRenderer(location, poolSize)
+	case BackendKroki:
+		renderer = NewKrokiRenderer(location)
+	default:
+		return nil, errUnknownRendererBackend
 	}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Criticalf(r.ctx, "Failed to request to renderer /form: %s", err)
-		return "", err
+
+	name := fmt.Sprintf("%s %s", backend, location)
+	return NewCachingRenderer(renderer, name, theme), nil
+}
+
+// PlantUMLServerRenderer renders with the API of plantuml-server.
+type PlantUMLServerRenderer struct {
+	BaseUrl string
+}
+
+func NewPlantUMLServerRenderer(baseUrl string) *PlantUMLServerRenderer {
+	return &PlantUMLServerRenderer{
+		BaseUrl: baseUrl,
 	}
-	defer resp.Body.Close()
+}
 
-	locationUrl, err := resp.Location()
+func (r *PlantUMLServerRenderer) Render(ctx context.Context, source string, format RenderFormat) ([]byte, error) {
+	umlId, err := EncodeUml(source)
 	if err != nil {
-		log.Criticalf(r.ctx, "Failed to get location header: %s", err)
-		return "", err
+		return nil, err
 	}
-	umlId := strings.TrimPrefix(locationUrl.Path, "/uml/")
 
-	return umlId, nil
+	return r.doRequest(ctx, "/"+string(format)+"/"+umlId)
 }
 
-func (r *Renderer) doRequest(path string) ([]byte, error) {
+func (r *PlantUMLServerRenderer) doRequest(ctx context.Context, path string) ([]byte, error) {
 	req, _ := http.NewRequest("GET", r.BaseUrl+path, nil)
 
-	client := urlfetch.Client(r.ctx)
+	client := urlfetch.Client(ctx)
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Criticalf(r.ctx, "Failed to request to %s: err=%s", path, err)
+		log.Criticalf(ctx, "Failed to request to %s: err=%s", path, err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	return ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRenderResponse(resp, body); err != nil {
+		return nil, err
+	}
+	return body, nil
 }
@@ -0,0 +1,270 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DEFAULT_PLANTUML_JAR_POOL_SIZE = 2
+	// plantUMLSyntaxMode is the mode of processes which check the syntax in place of rendering
+	plantUMLSyntaxMode = "syntax"
+)
+
+var (
+	plantUMLJarRenderer     *PlantUMLJarRenderer
+	plantUMLJarRendererOnce sync.Once
+
+	errPlantUMLPipeClosed = errors.New("plantuml.jar pipe is closed")
+)
+
+// PlantUMLJarRenderer renders with local plantuml.jar in `-pipe` mode.
+// Processes are kept running and reused, because starting a JVM takes longer than rendering.
+// A process renders one format, so there are idle processes up to the pool size for each format
+// and the syntax check, while the number of concurrent renderings is limited by the pool size.
+type PlantUMLJarRenderer struct {
+	JarPath string
+	pool    chan struct{}
+
+	mu   sync.Mutex
+	idle map[string][]*plantUMLPipe
+}
+
+func NewPlantUMLJarRenderer(jarPath string, poolSize int) *PlantUMLJarRenderer {
+	if poolSize <= 0 {
+		poolSize = DEFAULT_PLANTUML_JAR_POOL_SIZE
+	}
+	return &PlantUMLJarRenderer{
+		JarPath: jarPath,
+		pool:    make(chan struct{}, poolSize),
+		idle:    make(map[string][]*plantUMLPipe),
+	}
+}
+
+// sharedPlantUMLJarRenderer returns the renderer shared among requests so that the pool size is kept.
+func sharedPlantUMLJarRenderer(jarPath string, poolSize int) *PlantUMLJarRenderer {
+	plantUMLJarRendererOnce.Do(func() {
+		plantUMLJarRenderer = NewPlantUMLJarRenderer(jarPath, poolSize)
+	})
+	return plantUMLJarRenderer
+}
+
+// Render checks the syntax first, because a process in `-pipe` mode writes diagram errors
+// to stderr, which can't be told apart from the output of other diagrams.
+func (r *PlantUMLJarRenderer) Render(ctx context.Context, source string, format RenderFormat) ([]byte, error) {
+	select {
+	case r.pool <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-r.pool }()
+
+	// a process renders diagrams one by one, so the rest would be read as the next request
+	source = firstPlantUMLDiagram(source)
+
+	syntax, err := r.run(ctx, plantUMLSyntaxMode, source)
+	if err != nil {
+		return nil, err
+	}
+	if renderErr := parsePlantUMLJarError(string(syntax)); renderErr != nil {
+		return nil, renderErr
+	}
+	return r.run(ctx, string(format), source)
+}
+
+// run sends the source to an idle process of the mode, or a new one.
+// The process is killed if it fails or the deadline is exceeded, because its output can't be trusted anymore.
+func (r *PlantUMLJarRenderer) run(ctx context.Context, mode, source string) ([]byte, error) {
+	p, err := r.take(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := p.do(source)
+		done <- result{output, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			p.close()
+			return nil, fmt.Errorf("plantuml.jar failed: err=%s, stderr=%s", res.err, p.stderr.String())
+		}
+		r.release(mode, p)
+		return res.output, nil
+	case <-ctx.Done():
+		p.close()
+		return nil, ctx.Err()
+	}
+}
+
+func (r *PlantUMLJarRenderer) take(mode string) (*plantUMLPipe, error) {
+	r.mu.Lock()
+	if idle := r.idle[mode]; len(idle) > 0 {
+		p := idle[len(idle)-1]
+		r.idle[mode] = idle[:len(idle)-1]
+		r.mu.Unlock()
+		return p, nil
+	}
+	r.mu.Unlock()
+
+	args := []string{"-Djava.awt.headless=true", "-jar", r.JarPath, "-pipe", "-charset", "UTF-8"}
+	if mode == plantUMLSyntaxMode {
+		args = append(args, "-syntax")
+	} else {
+		args = append(args, "-t"+mode)
+	}
+	return startPlantUMLPipe(args)
+}
+
+func (r *PlantUMLJarRenderer) release(mode string, p *plantUMLPipe) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle[mode]) >= cap(r.pool) {
+		p.close()
+		return
+	}
+	r.idle[mode] = append(r.idle[mode], p)
+}
+
+// plantUMLPipe is a plantuml.jar process in `-pipe` mode, which writes the delimiter after each output.
+type plantUMLPipe struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	stdout    *bufio.Reader
+	stderr    *lockedBuffer
+	delimiter string
+}
+
+func startPlantUMLPipe(args []string) (*plantUMLPipe, error) {
+	// random, so that it doesn't appear in the output by chance
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	delimiter := "--plantuml-" + hex.EncodeToString(b) + "--"
+
+	cmd := exec.Command("java", append(args, "-pipedelimitor", delimiter)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &lockedBuffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &plantUMLPipe{
+		cmd:       cmd,
+		stdin:     stdin,
+		stdout:    bufio.NewReader(stdout),
+		stderr:    stderr,
+		delimiter: delimiter,
+	}, nil
+}
+
+func (p *plantUMLPipe) do(source string) ([]byte, error) {
+	p.stderr.Reset()
+	if !strings.HasSuffix(source, "\n") {
+		source += "\n"
+	}
+	if _, err := io.WriteString(p.stdin, source); err != nil {
+		return nil, err
+	}
+	return readPlantUMLPipeOutput(p.stdout, p.delimiter)
+}
+
+func (p *plantUMLPipe) close() {
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	go p.cmd.Wait()
+}
+
+// readPlantUMLPipeOutput reads the output of a diagram until the line of the delimiter.
+// The output may be binary such as PNG, so the delimiter is searched at the end of each read line.
+func readPlantUMLPipeOutput(r *bufio.Reader, delimiter string) ([]byte, error) {
+	suffix := []byte(delimiter + "\n")
+	var output []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		output = append(output, line...)
+		if bytes.HasSuffix(output, suffix) {
+			return output[:len(output)-len(suffix)], nil
+		}
+		if err == io.EOF {
+			return nil, errPlantUMLPipeClosed
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// firstPlantUMLDiagram drops lines after the first line of "@end", such as "@enduml".
+func firstPlantUMLDiagram(source string) string {
+	lines := strings.SplitAfter(source, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "@end") {
+			return strings.Join(lines[:i+1], "")
+		}
+	}
+	return source
+}
+
+// parsePlantUMLJarError parses the diagram error which `-syntax` mode writes,
+// in the form of "ERROR", the line number and the message in separate lines.
+func parsePlantUMLJarError(output string) *RenderError {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 3 || strings.TrimSpace(lines[0]) != "ERROR" {
+		return nil
+	}
+	line, _ := strconv.Atoi(strings.TrimSpace(lines[1]))
+	return &RenderError{
+		Message: strings.TrimSpace(strings.Join(lines[2:], " ")),
+		Line:    line,
+	}
+}
+
+// lockedBuffer keeps stderr of a process, which is written by exec while the output is read.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
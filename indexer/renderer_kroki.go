@@ -0,0 +1,46 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// KrokiRenderer renders with a Kroki-compatible endpoint.
+type KrokiRenderer struct {
+	BaseUrl string
+}
+
+func NewKrokiRenderer(baseUrl string) *KrokiRenderer {
+	return &KrokiRenderer{
+		BaseUrl: baseUrl,
+	}
+}
+
+func (r *KrokiRenderer) Render(ctx context.Context, source string, format RenderFormat) ([]byte, error) {
+	path := fmt.Sprintf("/plantuml/%s", format)
+	req, _ := http.NewRequest("POST", r.BaseUrl+path, strings.NewReader(source))
+	req.Header.Add("Content-Type", "text/plain")
+
+	client := urlfetch.Client(ctx)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Criticalf(ctx, "Failed to request to %s: err=%s", path, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRenderResponse(resp, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,152 @@
+package indexer
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckRenderResponse(t *testing.T) {
+	newResponse := func(status int, header map[string]string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: make(http.Header)}
+		for k, v := range header {
+			resp.Header.Set(k, v)
+		}
+		return resp
+	}
+
+	if err := checkRenderResponse(newResponse(http.StatusOK, nil), []byte("<svg/>")); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	var tests = []struct {
+		resp      *http.Response
+		body      string
+		expected  RenderError
+		temporary bool
+	}{
+		{
+			newResponse(http.StatusBadRequest, map[string]string{
+				PLANTUML_DIAGRAM_ERROR_HEADER:      "Syntax Error?",
+				PLANTUML_DIAGRAM_ERROR_LINE_HEADER: "3",
+				"Content-Type":                     "image/png",
+			}),
+			"\x89PNG",
+			RenderError{StatusCode: 400, Message: "Syntax Error?", Line: 3},
+			false,
+		},
+		{
+			newResponse(http.StatusOK, map[string]string{PLANTUML_DIAGRAM_ERROR_HEADER: "Syntax Error?"}),
+			"<svg/>",
+			RenderError{StatusCode: 400, Message: "Syntax Error?"},
+			false,
+		},
+		{
+			newResponse(http.StatusBadRequest, map[string]string{"Content-Type": "text/plain; charset=utf-8"}),
+			"Syntax Error? (line: 2)\n",
+			RenderError{StatusCode: 400, Message: "Syntax Error? (line: 2)"},
+			false,
+		},
+		{
+			newResponse(http.StatusServiceUnavailable, nil),
+			"",
+			RenderError{StatusCode: 503, Message: "Service Unavailable"},
+			true,
+		},
+		{
+			newResponse(http.StatusInternalServerError, map[string]string{PLANTUML_DIAGRAM_ERROR_HEADER: "Syntax Error?"}),
+			"",
+			RenderError{StatusCode: 400, Message: "Syntax Error?"},
+			false,
+		},
+		{
+			newResponse(http.StatusRequestTimeout, nil),
+			"",
+			RenderError{StatusCode: 408, Message: "Request Timeout"},
+			true,
+		},
+		{
+			newResponse(http.StatusTooManyRequests, map[string]string{"Content-Type": "text/plain"}),
+			"rate limited",
+			RenderError{StatusCode: 429, Message: "rate limited"},
+			true,
+		},
+		{
+			newResponse(http.StatusNotFound, nil),
+			"",
+			RenderError{StatusCode: 404, Message: "Not Found"},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		err := checkRenderResponse(test.resp, []byte(test.body))
+		renderErr, ok := err.(*RenderError)
+		if !ok {
+			t.Errorf("expected RenderError, but got %v", err)
+			continue
+		}
+		if *renderErr != test.expected {
+			t.Errorf("expected %+v, but got %+v", test.expected, *renderErr)
+		}
+		if renderErr.Temporary() != test.temporary {
+			t.Errorf("unexpected temporary: %+v", *renderErr)
+		}
+	}
+}
+
+func TestParsePlantUMLJarError(t *testing.T) {
+	renderErr := parsePlantUMLJarError("ERROR\n2\nSyntax Error?\nSome diagram description contains errors\n")
+	if renderErr == nil {
+		t.Fatal("expected RenderError")
+	}
+	if renderErr.Line != 2 || renderErr.Message != "Syntax Error? Some diagram description contains errors" {
+		t.Errorf("unexpected error: %+v", *renderErr)
+	}
+
+	if renderErr.Temporary() {
+		t.Errorf("error of plantuml.jar is of the diagram: %+v", *renderErr)
+	}
+
+	if renderErr := parsePlantUMLJarError("Error: Unable to access jarfile plantuml.jar"); renderErr != nil {
+		t.Errorf("expected nil, but got %+v", *renderErr)
+	}
+}
+
+func TestReadPlantUMLPipeOutput(t *testing.T) {
+	delimiter := "--delimiter--"
+	png := "\x89PNG\r\n\x1a\n\x00--delimiter-"
+	r := bufio.NewReader(strings.NewReader("<svg></svg>" + delimiter + "\n" + png + "\n" + delimiter + "\n" + "<svg>"))
+
+	for _, expected := range []string{"<svg></svg>", png + "\n"} {
+		got, err := readPlantUMLPipeOutput(r, delimiter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expected {
+			t.Errorf("not expected output: got=%q, expected=%q", got, expected)
+		}
+	}
+	if _, err := readPlantUMLPipeOutput(r, delimiter); err != errPlantUMLPipeClosed {
+		t.Errorf("not expected error: got=%v", err)
+	}
+}
+
+func TestFirstPlantUMLDiagram(t *testing.T) {
+	var tests = []struct {
+		source   string
+		expected string
+	}{
+		{"@startuml\nA -> B\n@enduml", "@startuml\nA -> B\n@enduml"},
+		{"@startuml\nA -> B\n  @enduml\n@startuml\nB -> C\n@enduml\n", "@startuml\nA -> B\n  @enduml\n"},
+		{"@startmindmap\n* root\n@endmindmap\ntrailing", "@startmindmap\n* root\n@endmindmap\n"},
+		{"A -> B", "A -> B"},
+	}
+
+	for _, test := range tests {
+		if got := firstPlantUMLDiagram(test.source); got != test.expected {
+			t.Errorf("not expected source: got=%q, expected=%q", got, test.expected)
+		}
+	}
+}
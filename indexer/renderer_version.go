@@ -0,0 +1,102 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	RENDERER_VERSION_TTL = 10 * time.Minute
+	versionDiagramSource = "@startuml\nversion\n@enduml"
+)
+
+var plantUMLVersionPattern = regexp.MustCompile(`PlantUML version ([0-9][0-9A-Za-z.\-]*)`)
+
+// parsePlantUMLVersion parses the output of the `version` diagram.
+func parsePlantUMLVersion(text string) (string, error) {
+	matched := plantUMLVersionPattern.FindStringSubmatch(text)
+	if len(matched) != 2 {
+		return "", fmt.Errorf("no version in the output: %q", text)
+	}
+	return matched[1], nil
+}
+
+// detectRendererVersion renders the `version` diagram, which shows the version of PlantUML.
+func detectRendererVersion(ctx context.Context, renderer Renderer) (string, error) {
+	text, err := renderer.Render(ctx, versionDiagramSource, FormatAscii)
+	if err != nil {
+		return "", err
+	}
+	return parsePlantUMLVersion(string(text))
+}
+
+// RendererVersion returns the PlantUML version of the renderer, which is cached if it's behind the render cache.
+func RendererVersion(ctx context.Context, renderer Renderer) (string, error) {
+	if cachingRenderer, ok := renderer.(*CachingRenderer); ok {
+		return rendererVersions.Get(ctx, cachingRenderer.Name, cachingRenderer.Renderer)
+	}
+	return detectRendererVersion(ctx, renderer)
+}
+
+type rendererVersion struct {
+	version    string
+	detectedAt time.Time
+}
+
+// rendererVersionCache keeps detected versions for a while, because the renderer may be upgraded
+// while the indexer is running. Concurrent detections of the same renderer are merged into one,
+// so that formats rendered in parallel don't render the `version` diagram each.
+type rendererVersionCache struct {
+	mu        sync.Mutex
+	versions  map[string]rendererVersion
+	detecting map[string]*rendererVersionDetection
+}
+
+type rendererVersionDetection struct {
+	done    chan struct{}
+	version string
+	err     error
+}
+
+var rendererVersions = newRendererVersionCache()
+
+func newRendererVersionCache() *rendererVersionCache {
+	return &rendererVersionCache{
+		versions:  make(map[string]rendererVersion),
+		detecting: make(map[string]*rendererVersionDetection),
+	}
+}
+
+func (c *rendererVersionCache) Get(ctx context.Context, name string, renderer Renderer) (string, error) {
+	c.mu.Lock()
+	if cached, ok := c.versions[name]; ok && time.Since(cached.detectedAt) < RENDERER_VERSION_TTL {
+		c.mu.Unlock()
+		return cached.version, nil
+	}
+	if detection, ok := c.detecting[name]; ok {
+		c.mu.Unlock()
+		select {
+		case <-detection.done:
+			return detection.version, detection.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	detection := &rendererVersionDetection{done: make(chan struct{})}
+	c.detecting[name] = detection
+	c.mu.Unlock()
+
+	detection.version, detection.err = detectRendererVersion(ctx, renderer)
+
+	c.mu.Lock()
+	delete(c.detecting, name)
+	if detection.err == nil {
+		c.versions[name] = rendererVersion{version: detection.version, detectedAt: time.Now()}
+	}
+	c.mu.Unlock()
+	close(detection.done)
+	return detection.version, detection.err
+}
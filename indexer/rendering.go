@@ -0,0 +1,95 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// renderingContentTypes are the formats which the web offers for downloads in addition to the ones in Uml.
+var renderingContentTypes = map[RenderFormat]string{
+	FormatUnicode: "text/plain; charset=utf-8",
+	FormatPdf:     "application/pdf",
+	FormatEps:     "application/postscript",
+	FormatLatex:   "application/x-latex",
+}
+
+var errUnsupportedRenderingFormat = errors.New("unsupported rendering format")
+
+// UmlRendering is an output of the format which isn't stored in Uml, which is rendered on the first download.
+// The key is the format name whose parent is the Uml.
+type UmlRendering struct {
+	Ref       string    `datastore:"ref,noindex"`
+	CreatedAt time.Time `datastore:"createdAt,noindex"`
+}
+
+// CreateUmlRendering renders the Uml in the format and stores it in the blob store, unless it's rendered already.
+// It returns datastore.ErrNoSuchEntity if the Uml doesn't exist.
+func CreateUmlRendering(ctx context.Context, indexer *Indexer, umlId int64, format RenderFormat) ([]byte, error) {
+	contentType, ok := renderingContentTypes[format]
+	if !ok {
+		return nil, errUnsupportedRenderingFormat
+	}
+
+	umlKey := datastore.NewKey(ctx, "Uml", "", umlId, nil)
+	key := datastore.NewKey(ctx, "UmlRendering", string(format), 0, umlKey)
+	var rendering UmlRendering
+	err := datastore.Get(ctx, key, &rendering)
+	if err == nil {
+		return indexer.Blobs.Get(ctx, rendering.Ref)
+	}
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	var uml Uml
+	if err := datastore.Get(ctx, umlKey, &uml); err != nil {
+		return nil, err
+	}
+	data, err := indexer.renderFormat(ctx, uml.Source, format)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := indexer.Blobs.Put(ctx, data, contentType)
+	if err != nil {
+		return nil, err
+	}
+	rendering = UmlRendering{
+		Ref:       ref,
+		CreatedAt: time.Now(),
+	}
+	if _, err := datastore.Put(ctx, key, &rendering); err != nil {
+		// serve it anyway, and the same blob is put next time
+		log.Errorf(ctx, "failed to save rendering: %s", err)
+	}
+	return data, nil
+}
+
+// renderFormat renders one format with the breaker in the same way as rendering the formats of Uml.
+func (idxr *Indexer) renderFormat(ctx context.Context, source string, format RenderFormat) ([]byte, error) {
+	if err := idxr.takeRendererTokens(ctx, 1); err != nil {
+		return nil, err
+	}
+	if idxr.Breaker != nil && !idxr.Breaker.Allow(time.Now()) {
+		return nil, errRendererUnavailable
+	}
+
+	data, err := renderWithRetry(ctx, idxr.Renderer, source, format)
+	if idxr.Breaker == nil {
+		return data, err
+	}
+	_, timedOut := err.(*RenderTimeoutError)
+	switch {
+	case err == nil, isDiagramError(err):
+		idxr.Breaker.RecordSuccess()
+	case timedOut, ctx.Err() != nil:
+		idxr.Breaker.Release()
+	default:
+		idxr.Breaker.RecordFailure(time.Now())
+	}
+	return data, err
+}
@@ -0,0 +1,400 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	SCHEDULER_TICK_INTERVAL        = time.Minute
+	SCHEDULER_MAX_IMPORTS_PER_TICK = 50
+	PENDING_INDEX_PUT_BATCH_SIZE   = 500
+)
+
+const (
+	GITHUB_BUCKET   = "github"
+	RENDERER_BUCKET = "renderer"
+)
+
+// A dispatched task takes a token of the github bucket, because it requests GitHub once.
+// Tokens of the renderer bucket are taken by the indexer at render time for each format of a source,
+// because the number of sources in a file is unknown until it's fetched.
+var hostBuckets = []HostBucketConfig{
+	// GitHub API allows 5000 requests per hour for an authenticated user
+	{Name: GITHUB_BUCKET, RatePerSecond: 1.0},
+	{Name: RENDERER_BUCKET, RatePerSecond: 2.0},
+}
+
+var priorityOrder = []ImportPriority{PriorityHigh, PriorityNormal, PriorityLow}
+
+type HostBucketConfig struct {
+	Name          string
+	RatePerSecond float64
+}
+
+// Capacity is enough for one tick so that an idle period doesn't make a burst.
+func (c HostBucketConfig) Capacity() float64 {
+	return c.RatePerSecond * SCHEDULER_TICK_INTERVAL.Seconds()
+}
+
+type TokenBucket struct {
+	Tokens    float64   `datastore:"tokens,noindex" json:"tokens"`
+	UpdatedAt time.Time `datastore:"updatedAt,noindex" json:"updatedAt"`
+}
+
+func (b *TokenBucket) Refill(config HostBucketConfig, now time.Time) {
+	if b.UpdatedAt.IsZero() {
+		b.Tokens = config.Capacity()
+	} else if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(config.Capacity(), b.Tokens+elapsed*config.RatePerSecond)
+	}
+	b.UpdatedAt = now
+}
+
+// Available returns the number of whole tokens in the bucket.
+func (b *TokenBucket) Available() int {
+	return int(math.Floor(b.Tokens))
+}
+
+func (b *TokenBucket) Take(n int) {
+	b.Tokens -= float64(n)
+}
+
+// PendingIndex is an index creation which is waiting to be dispatched by the scheduler.
+type PendingIndex struct {
+	ImportId  int64          `datastore:"importId"`
+	Url       string         `datastore:"url,noindex"`
+	Tags      []string       `datastore:"tags,noindex"`
+	Priority  ImportPriority `datastore:"priority"`
+	Seq       int            `datastore:"seq"`
+	CreatedAt time.Time      `datastore:"createdAt,noindex"`
+
+	key *datastore.Key `datastore:"-"`
+}
+
+type SchedulerStatus struct {
+	Buckets         map[string]*TokenBucket          `json:"buckets"`
+	Pending         map[ImportPriority]map[int64]int `json:"pending"`
+	RendererBreaker BreakerState                     `json:"rendererBreaker"`
+}
+
+// schedulePendingIndexes saves pending indexes of the items, and returns the number of saved ones.
+func schedulePendingIndexes(ctx context.Context, importId int64, items []*ImportItem) (int, error) {
+	now := time.Now()
+	scheduled := 0
+	for start := 0; start < len(items); start += PENDING_INDEX_PUT_BATCH_SIZE {
+		end := start + PENDING_INDEX_PUT_BATCH_SIZE
+		if end > len(items) {
+			end = len(items)
+		}
+
+		keys := make([]*datastore.Key, end-start)
+		pendings := make([]*PendingIndex, end-start)
+		for i, item := range items[start:end] {
+			keys[i] = datastore.NewIncompleteKey(ctx, "PendingIndex", nil)
+			pendings[i] = &PendingIndex{
+				ImportId:  importId,
+				Url:       item.Url,
+				Tags:      item.Tags,
+				Priority:  item.Priority,
+				Seq:       start + i,
+				CreatedAt: now,
+			}
+		}
+		if _, err := datastore.PutMulti(ctx, keys, pendings); err != nil {
+			return scheduled, err
+		}
+		scheduled += len(pendings)
+	}
+	return scheduled, nil
+}
+
+// RunSchedulerTick dispatches pending indexes as many as the host buckets allow.
+// Higher priorities are dispatched first, and imports of the same priority are interleaved.
+func RunSchedulerTick(ctx context.Context) (int, error) {
+	now := time.Now()
+	breakerState := rendererBreaker.State(now)
+	if breakerState == BreakerOpen {
+		log.Warningf(ctx, "renderer circuit breaker is open, skip dispatching")
+		return 0, nil
+	}
+
+	buckets, err := loadHostBuckets(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	budget := buckets[GITHUB_BUCKET].Available()
+	// tasks would fail until the renderer bucket is refilled
+	if buckets[RENDERER_BUCKET].Available() < len(renderFormats) {
+		budget = 0
+	}
+	// the breaker allows only one probe, so the others would fail
+	if breakerState == BreakerHalfOpen && budget > 1 {
+		budget = 1
+	}
+	log.Infof(ctx, "scheduler budget: %d", budget)
+
+	var dispatching []*PendingIndex
+	for _, priority := range priorityOrder {
+		if len(dispatching) >= budget {
+			break
+		}
+		groups, err := fetchPendingIndexGroups(ctx, priority, budget-len(dispatching))
+		if err != nil {
+			return 0, err
+		}
+		dispatching = append(dispatching, interleavePendingIndexes(groups, budget-len(dispatching))...)
+	}
+
+	dispatched := 0
+	for i, pending := range dispatching {
+		// spread tasks over the tick interval
+		delay := SCHEDULER_TICK_INTERVAL * time.Duration(i) / time.Duration(len(dispatching))
+		if err := addIndexCreateTask(ctx, pending, delay); err != nil {
+			log.Criticalf(ctx, "failed to add task: url=%s, err=%s", pending.Url, err)
+			continue
+		}
+		if err := datastore.Delete(ctx, pending.key); err != nil {
+			// the task name prevents it from being dispatched twice
+			log.Errorf(ctx, "failed to delete pending index: %s", err)
+		}
+		dispatched++
+	}
+
+	if dispatched > 0 {
+		if _, err := takeHostTokens(ctx, GITHUB_BUCKET, dispatched, true); err != nil {
+			return dispatched, err
+		}
+	}
+	return dispatched, nil
+}
+
+func addIndexCreateTask(ctx context.Context, pending *PendingIndex, delay time.Duration) error {
+	body := &IndexCreateRequestBody{
+		Url:      pending.Url,
+		ImportId: pending.ImportId,
+		Tags:     pending.Tags,
+		Priority: pending.Priority,
+	}
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	task := &Task{
+		Name:    fmt.Sprintf("pending-index-%d", pending.key.IntID()),
+		Path:    "/indexes",
+		Payload: bodyBytes,
+		Delay:   delay,
+	}
+	err = taskQueue.Add(ctx, task, INDEX_CREATE_QUEUE)
+	if err == ErrTaskAlreadyAdded {
+		return nil
+	}
+	return err
+}
+
+// SchedulerCursor is the last import of a priority whose pending indexes are fetched,
+// so that the next tick starts from the following imports.
+type SchedulerCursor struct {
+	LastImportId int64 `datastore:"lastImportId,noindex"`
+}
+
+// fetchPendingIndexGroups returns pending indexes of the priority grouped by import.
+// Imports are fetched after the cursor in order of the ID, and it wraps around to the first import,
+// so that every import is dispatched in turn. At most the limit of imports are fetched,
+// so that each of them gets a pending index dispatched before the cursor passes it.
+func fetchPendingIndexGroups(ctx context.Context, priority ImportPriority, limit int) ([][]*PendingIndex, error) {
+	cursorKey := datastore.NewKey(ctx, "SchedulerCursor", string(priority), 0, nil)
+	var cursor SchedulerCursor
+	if err := datastore.Get(ctx, cursorKey, &cursor); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	maxImports := SCHEDULER_MAX_IMPORTS_PER_TICK
+	if limit < maxImports {
+		maxImports = limit
+	}
+	heads, err := fetchPendingImportHeads(ctx, priority, "importId >", cursor.LastImportId, maxImports)
+	if err != nil {
+		return nil, err
+	}
+	if len(heads) < maxImports && cursor.LastImportId != 0 {
+		wrapped, err := fetchPendingImportHeads(ctx, priority, "importId <=", cursor.LastImportId, maxImports-len(heads))
+		if err != nil {
+			return nil, err
+		}
+		heads = append(heads, wrapped...)
+	}
+
+	if len(heads) > 0 {
+		cursor.LastImportId = heads[len(heads)-1].ImportId
+		if _, err := datastore.Put(ctx, cursorKey, &cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	groups := make([][]*PendingIndex, 0, len(heads))
+	for _, head := range heads {
+		var pendings []*PendingIndex
+		q := datastore.NewQuery("PendingIndex").
+			Filter("importId =", head.ImportId).
+			Filter("priority =", priority).
+			Order("seq").
+			Limit(limit)
+		keys, err := q.GetAll(ctx, &pendings)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			pendings[i].key = key
+		}
+		groups = append(groups, pendings)
+	}
+	return groups, nil
+}
+
+func fetchPendingImportHeads(ctx context.Context, priority ImportPriority, filter string, importId int64, limit int) ([]PendingIndex, error) {
+	var heads []PendingIndex
+	q := datastore.NewQuery("PendingIndex").
+		Filter("priority =", priority).
+		Filter(filter, importId).
+		Project("importId").
+		Distinct().
+		Order("importId").
+		Limit(limit)
+	if _, err := q.GetAll(ctx, &heads); err != nil {
+		return nil, err
+	}
+	return heads, nil
+}
+
+// interleavePendingIndexes takes one item from each group in turn, so that a huge import doesn't starve others.
+func interleavePendingIndexes(groups [][]*PendingIndex, limit int) []*PendingIndex {
+	var result []*PendingIndex
+	for i := 0; len(result) < limit; i++ {
+		taken := false
+		for _, group := range groups {
+			if i < len(group) {
+				result = append(result, group[i])
+				taken = true
+				if len(result) == limit {
+					break
+				}
+			}
+		}
+		if !taken {
+			break
+		}
+	}
+	return result
+}
+
+func loadHostBuckets(ctx context.Context, now time.Time) (map[string]*TokenBucket, error) {
+	keys := make([]*datastore.Key, len(hostBuckets))
+	loaded := make([]*TokenBucket, len(hostBuckets))
+	for i, config := range hostBuckets {
+		keys[i] = hostBucketKey(ctx, config.Name)
+		loaded[i] = &TokenBucket{}
+	}
+
+	err := datastore.GetMulti(ctx, keys, loaded)
+	if multiErr, ok := err.(appengine.MultiError); ok {
+		for _, e := range multiErr {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[string]*TokenBucket)
+	for i, bucket := range loaded {
+		bucket.Refill(hostBuckets[i], now)
+		buckets[hostBuckets[i].Name] = bucket
+	}
+	return buckets, nil
+}
+
+// takeHostTokens takes n tokens from the bucket in a transaction, because the renderer bucket
+// is taken by concurrent tasks. It takes nothing and returns false if there are not enough tokens,
+// unless force is true, such as for tasks which are dispatched already.
+func takeHostTokens(ctx context.Context, name string, n int, force bool) (bool, error) {
+	var config HostBucketConfig
+	for _, c := range hostBuckets {
+		if c.Name == name {
+			config = c
+		}
+	}
+	if config.Name == "" {
+		return false, fmt.Errorf("unknown host bucket: %s", name)
+	}
+
+	key := hostBucketKey(ctx, name)
+	taken := false
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var bucket TokenBucket
+		if err := datastore.Get(ctx, key, &bucket); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		bucket.Refill(config, time.Now())
+		if !force && bucket.Available() < n {
+			taken = false
+			return nil
+		}
+		bucket.Take(n)
+		taken = true
+		_, err := datastore.Put(ctx, key, &bucket)
+		return err
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+	return taken, nil
+}
+
+func hostBucketKey(ctx context.Context, name string) *datastore.Key {
+	return datastore.NewKey(ctx, "HostBucket", name, 0, nil)
+}
+
+func FetchSchedulerStatus(ctx context.Context) (*SchedulerStatus, error) {
+	buckets, err := loadHostBuckets(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	status := &SchedulerStatus{
+		Buckets:         buckets,
+		Pending:         make(map[ImportPriority]map[int64]int),
+		RendererBreaker: rendererBreaker.State(time.Now()),
+	}
+
+	for _, priority := range priorityOrder {
+		var heads []PendingIndex
+		q := datastore.NewQuery("PendingIndex").Filter("priority =", priority).Project("importId").Distinct()
+		if _, err := q.GetAll(ctx, &heads); err != nil {
+			return nil, err
+		}
+		counts := make(map[int64]int)
+		for _, head := range heads {
+			q := datastore.NewQuery("PendingIndex").Filter("importId =", head.ImportId).Filter("priority =", priority).KeysOnly()
+			n, err := q.Count(ctx)
+			if err != nil {
+				return nil, err
+			}
+			counts[head.ImportId] = n
+		}
+		status.Pending[priority] = counts
+	}
+
+	return status, nil
+}
@@ -0,0 +1,54 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	config := HostBucketConfig{Name: "test", RatePerSecond: 0.5}
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var bucket TokenBucket
+	bucket.Refill(config, now)
+	if got := bucket.Available(); got != 30 {
+		t.Errorf("new bucket should be full: got=%d", got)
+	}
+
+	bucket.Take(30)
+	bucket.Refill(config, now.Add(5*time.Second))
+	if got := bucket.Available(); got != 2 {
+		t.Errorf("not expected tokens after 5 seconds: got=%d", got)
+	}
+
+	bucket.Refill(config, now.Add(time.Hour))
+	if got := bucket.Available(); got != 30 {
+		t.Errorf("bucket should not exceed its capacity: got=%d", got)
+	}
+}
+
+func TestInterleavePendingIndexes(t *testing.T) {
+	big := []*PendingIndex{{Url: "a1"}, {Url: "a2"}, {Url: "a3"}, {Url: "a4"}}
+	small := []*PendingIndex{{Url: "b1"}}
+
+	var tests = []struct {
+		limit    int
+		expected []string
+	}{
+		{10, []string{"a1", "b1", "a2", "a3", "a4"}},
+		{3, []string{"a1", "b1", "a2"}},
+		{1, []string{"a1"}},
+		{0, []string{}},
+	}
+
+	for _, test := range tests {
+		got := interleavePendingIndexes([][]*PendingIndex{big, small}, test.limit)
+		urls := make([]string, len(got))
+		for i, pending := range got {
+			urls[i] = pending.Url
+		}
+		if !isSameSources(urls, test.expected) {
+			t.Errorf("not expected order: limit=%d, got=%#v, expected=%#v", test.limit, urls, test.expected)
+		}
+	}
+}
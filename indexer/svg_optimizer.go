@@ -0,0 +1,299 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/yfuruyama/real-world-plantuml/svgsanitizer"
+)
+
+const (
+	SVG_COORDINATE_PRECISION = 2
+)
+
+// svgPresentationProperties are moved from style to attributes, which are shorter than
+// the verbose styles of PlantUML such as "stroke: #A80036; stroke-width: 1.0;".
+var svgPresentationProperties = map[string]bool{
+	"fill": true, "fill-opacity": true, "fill-rule": true, "opacity": true,
+	"stroke": true, "stroke-width": true, "stroke-dasharray": true, "stroke-dashoffset": true,
+	"stroke-linecap": true, "stroke-linejoin": true, "stroke-miterlimit": true, "stroke-opacity": true,
+	"font-family": true, "font-size": true, "font-style": true, "font-weight": true, "text-decoration": true,
+}
+
+// svgNumericAttributes are rounded to SVG_COORDINATE_PRECISION.
+var svgNumericAttributes = map[string]bool{
+	"x": true, "y": true, "x1": true, "x2": true, "y1": true, "y2": true, "cx": true, "cy": true,
+	"r": true, "rx": true, "ry": true, "dx": true, "dy": true, "width": true, "height": true,
+	"d": true, "points": true, "transform": true, "viewBox": true, "textLength": true,
+	"stroke-width": true, "stroke-dasharray": true, "stroke-dashoffset": true, "font-size": true,
+}
+
+// svgDroppedAttributes have no effect in browsers.
+var svgDroppedAttributes = map[string]bool{
+	"contentScriptType": true, "contentStyleType": true, "zoomAndPan": true,
+}
+
+// whitespace is significant only in texts
+var svgTextElements = map[string]bool{
+	"text": true, "tspan": true, "textPath": true, "title": true, "desc": true,
+}
+
+var (
+	svgNumberPattern = regexp.MustCompile(`-?[0-9.]+`)
+	svgIdRefPattern  = regexp.MustCompile(`url\(\s*['"]?#([^'")\s]+)`)
+)
+
+type svgNode struct {
+	// Name is empty for a text
+	Name     string
+	Attrs    []xml.Attr
+	Children []*svgNode
+	Text     string
+}
+
+func (n *svgNode) attr(name string) (string, bool) {
+	for _, attr := range n.Attrs {
+		if attr.Name.Local == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+func (n *svgNode) setAttr(name, value string) {
+	for i, attr := range n.Attrs {
+		if attr.Name.Local == name {
+			n.Attrs[i].Value = value
+			return
+		}
+	}
+	n.Attrs = append(n.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+// OptimizeSvg makes the SVG smaller for the listing: styles are merged into attributes,
+// coordinates are rounded, and the XML declaration, comments and unused defs are dropped.
+// The SVG must be sanitized, because the output is not sanitized again by the indexer.
+func OptimizeSvg(svg []byte) ([]byte, error) {
+	root, err := parseSvgTree(svg)
+	if err != nil {
+		return nil, err
+	}
+
+	optimizeSvgNode(root)
+	for removeUnusedSvgDefs(root, referencedSvgIds(root)) {
+		// defs may refer to each other, such as gradients
+	}
+
+	var buf bytes.Buffer
+	writeSvgNode(&buf, root)
+	return buf.Bytes(), nil
+}
+
+func parseSvgTree(svg []byte) (*svgNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(svg))
+	decoder.Entity = xml.HTMLEntity
+
+	var root *svgNode
+	var stack []*svgNode
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &svgNode{Name: svgsanitizer.QualifiedName(t.Name)}
+			for _, attr := range t.Attr {
+				name := svgsanitizer.QualifiedName(attr.Name)
+				node.Attrs = append(node.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: attr.Value})
+			}
+			if len(stack) == 0 {
+				if root != nil || node.Name != "svg" {
+					return nil, svgsanitizer.ErrNotSvg
+				}
+				root = node
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("unexpected end element %s", svgsanitizer.QualifiedName(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) == 0 {
+				continue
+			}
+			parent := stack[len(stack)-1]
+			text := string(t)
+			if strings.TrimSpace(text) == "" && !svgTextElements[parent.Name] {
+				continue
+			}
+			parent.Children = append(parent.Children, &svgNode{Text: text})
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("unclosed element %s", stack[len(stack)-1].Name)
+	}
+	if root == nil {
+		return nil, svgsanitizer.ErrNotSvg
+	}
+	return root, nil
+}
+
+func optimizeSvgNode(node *svgNode) {
+	if node.Name == "" {
+		return
+	}
+
+	if style, ok := node.attr("style"); ok {
+		node.Attrs = removeSvgAttr(node.Attrs, "style")
+		var rest []string
+		for _, declaration := range strings.Split(style, ";") {
+			parts := strings.SplitN(declaration, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			property := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+			// !important can't be an attribute
+			if svgPresentationProperties[property] && !strings.Contains(value, "!") {
+				// a style takes precedence over the attribute
+				node.setAttr(property, value)
+			} else {
+				rest = append(rest, property+":"+value)
+			}
+		}
+		if len(rest) > 0 {
+			node.setAttr("style", strings.Join(rest, ";"))
+		}
+	}
+
+	attrs := node.Attrs[:0]
+	for _, attr := range node.Attrs {
+		if svgDroppedAttributes[attr.Name.Local] {
+			continue
+		}
+		if svgNumericAttributes[attr.Name.Local] {
+			attr.Value = roundSvgNumbers(attr.Value)
+		}
+		attrs = append(attrs, attr)
+	}
+	node.Attrs = attrs
+
+	for _, child := range node.Children {
+		optimizeSvgNode(child)
+	}
+}
+
+func removeSvgAttr(attrs []xml.Attr, name string) []xml.Attr {
+	var removed []xml.Attr
+	for _, attr := range attrs {
+		if attr.Name.Local != name {
+			removed = append(removed, attr)
+		}
+	}
+	return removed
+}
+
+// roundSvgNumbers rounds decimals in the value, and drops trailing zeros such as "1.0".
+func roundSvgNumbers(value string) string {
+	return svgNumberPattern.ReplaceAllStringFunc(value, func(number string) string {
+		// integers, and numbers without separators such as "1.5.5" in paths are kept as is
+		if strings.Count(number, ".") != 1 {
+			return number
+		}
+		f, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return number
+		}
+		scale := math.Pow(10, SVG_COORDINATE_PRECISION)
+		rounded := math.Floor(f*scale+0.5) / scale
+		if rounded == 0 {
+			// no "-0"
+			return "0"
+		}
+		return strconv.FormatFloat(rounded, 'f', -1, 64)
+	})
+}
+
+// referencedSvgIds returns IDs which are referred by url(#id) or href="#id".
+func referencedSvgIds(node *svgNode) map[string]bool {
+	ids := make(map[string]bool)
+	var walk func(node *svgNode)
+	walk = func(node *svgNode) {
+		for _, attr := range node.Attrs {
+			if attr.Name.Local == "href" || attr.Name.Local == "xlink:href" {
+				if strings.HasPrefix(attr.Value, "#") {
+					ids[attr.Value[1:]] = true
+				}
+				continue
+			}
+			for _, matched := range svgIdRefPattern.FindAllStringSubmatch(attr.Value, -1) {
+				ids[matched[1]] = true
+			}
+		}
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	walk(node)
+	return ids
+}
+
+// removeUnusedSvgDefs removes children of defs which are not referred, and empty defs.
+// It reports whether anything is removed.
+func removeUnusedSvgDefs(node *svgNode, referenced map[string]bool) bool {
+	removed := false
+	var children []*svgNode
+	for _, child := range node.Children {
+		if node.Name == "defs" && child.Name != "" {
+			if id, _ := child.attr("id"); !referenced[id] {
+				removed = true
+				continue
+			}
+		}
+		if removeUnusedSvgDefs(child, referenced) {
+			removed = true
+		}
+		if child.Name == "defs" && len(child.Children) == 0 {
+			removed = true
+			continue
+		}
+		children = append(children, child)
+	}
+	node.Children = children
+	return removed
+}
+
+func writeSvgNode(buf *bytes.Buffer, node *svgNode) {
+	if node.Name == "" {
+		buf.WriteString(svgsanitizer.EscapeText(node.Text))
+		return
+	}
+	buf.WriteString("<" + node.Name)
+	for _, attr := range node.Attrs {
+		fmt.Fprintf(buf, ` %s="%s"`, attr.Name.Local, svgsanitizer.EscapeAttr(attr.Value))
+	}
+	if len(node.Children) == 0 {
+		buf.WriteString("/>")
+		return
+	}
+	buf.WriteString(">")
+	for _, child := range node.Children {
+		writeSvgNode(buf, child)
+	}
+	buf.WriteString("</" + node.Name + ">")
+}
@@ -0,0 +1,41 @@
+package indexer
+
+import (
+	"testing"
+)
+
+func TestOptimizeSvg(t *testing.T) {
+	tests := []struct {
+		svg      string
+		expected string
+	}{
+		{
+			`<?xml version="1.0" encoding="UTF-8" standalone="no"?><svg xmlns="http://www.w3.org/2000/svg" contentScriptType="application/ecmascript" zoomAndPan="magnify" style="width:246px;height:156px;" viewBox="0 0 246 156">
+<defs><filter id="f1"><feOffset dx="4.0" dy="4.0"/></filter><filter id="unused"/></defs>
+<g><line style="stroke: #A80036; stroke-width: 1.0; stroke-dasharray: 5.0,5.0;" x1="33" y1="38.2969"/><rect filter="url(#f1)" fill="#FEFECE" style="fill: #FFFFFF;"/><text x="15" y="22.9951"> Alice </text></g></svg>`,
+			`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 246 156" style="width:246px;height:156px"><defs><filter id="f1"><feOffset dx="4" dy="4"/></filter></defs><g><line x1="33" y1="38.3" stroke="#A80036" stroke-width="1" stroke-dasharray="5,5"/><rect filter="url(#f1)" fill="#FFFFFF"/><text x="15" y="23"> Alice </text></g></svg>`,
+		},
+		{
+			`<svg><!-- metadata --><defs><linearGradient id="a"/><linearGradient id="b" xlink:href="#a"/></defs><rect/></svg>`,
+			`<svg><rect/></svg>`,
+		},
+		{
+			`<svg><path d="M10.125,-0.001 L1.5.5 L-3.456,7"/></svg>`,
+			`<svg><path d="M10.13,0 L1.5.5 L-3.46,7"/></svg>`,
+		},
+	}
+	for _, test := range tests {
+		optimized, err := OptimizeSvg([]byte(test.svg))
+		if err != nil {
+			t.Errorf("failed to optimize %s: %s", test.svg, err)
+			continue
+		}
+		if string(optimized) != test.expected {
+			t.Errorf("expected %s, but got %s", test.expected, optimized)
+		}
+	}
+
+	if _, err := OptimizeSvg([]byte(`<svg><g></svg>`)); err == nil {
+		t.Errorf("expected an error for a broken svg")
+	}
+}
@@ -1,37 +1,74 @@
 package indexer
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"regexp"
 	"strings"
 
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/urlfetch"
 )
 
+const (
+	SYNTAX_CHECK_BATCH_SIZE = 50
+)
+
 type SyntaxCheckRequest struct {
 	Source string `json:"source"`
 }
 
+type SyntaxCheckBatchRequest struct {
+	Sources []string `json:"sources"`
+}
+
+// SyntaxCheckBatchItem is the result of a source in the batch, or the error if the check fails.
+type SyntaxCheckBatchItem struct {
+	Result *SyntaxCheckResult `json:"result,omitempty"`
+	Error  string             `json:"error,omitempty"`
+}
+
+type SyntaxCheckBatchResponse struct {
+	Results []SyntaxCheckBatchItem `json:"results"`
+}
+
 type SyntaxCheckResult struct {
 	Valid       bool   `json:"valid"`
 	DiagramType string `json:"diagramType"`
 	Description string `json:"description"`
+	// ErrorLine is the line of the first error in the source starting from 1, or 0 if it's valid
+	ErrorLine   int      `json:"errorLine,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+	Suggestions []string `json:"suggestions,omitempty"`
+	// ElementCount is the number of elements such as participants, which is nil if the checker can't tell
+	ElementCount *int `json:"elementCount"`
 }
 
 func (r *SyntaxCheckResult) HasValidDiagram() bool {
-	re := regexp.MustCompile(`^\(([0-9]+) .+\)$`)
-	matched := re.FindStringSubmatch(r.Description)
-	if len(matched) != 2 {
-		// regard unexpected description as valid
-		return true
+	// regard an unknown count as valid
+	return r.ElementCount == nil || *r.ElementCount != 0
+}
+
+// Elements returns the number of elements, or -1 if it's unknown.
+func (r *SyntaxCheckResult) Elements() int {
+	if r.ElementCount == nil {
+		return -1
+	}
+	return *r.ElementCount
+}
+
+// ErrorMessage summarizes errors of an invalid result, such as "line 3: Syntax Error?".
+func (r *SyntaxCheckResult) ErrorMessage() string {
+	if r.Valid {
+		return ""
 	}
-	if matched[1] == "0" {
-		return false
+	message := strings.Join(r.Errors, ", ")
+	if r.ErrorLine > 0 {
+		return fmt.Sprintf("line %d: %s", r.ErrorLine, message)
 	}
-	return true
+	return message
 }
 
 type SyntaxChecker struct {
@@ -47,17 +84,58 @@ func NewSyntaxChecker(ctx context.Context, baseUrl string) *SyntaxChecker {
 }
 
 func (s *SyntaxChecker) CheckSyntax(source string) (*SyntaxCheckResult, error) {
-	checkReq := &SyntaxCheckRequest{source}
-	reqBody, err := json.Marshal(checkReq)
-	if err != nil {
+	var result SyntaxCheckResult
+	if err := s.post("/check_syntax", &SyntaxCheckRequest{source}, &result); err != nil {
 		return nil, err
 	}
+	return &result, nil
+}
+
+// CheckSyntaxBatch checks the sources in requests of up to SYNTAX_CHECK_BATCH_SIZE sources.
+// An item fails alone if the checker fails for the source, and the error is set to the item.
+func (s *SyntaxChecker) CheckSyntaxBatch(sources []string) ([]SyntaxCheckBatchItem, error) {
+	return checkSyntaxInBatches(sources, func(batch []string) ([]SyntaxCheckBatchItem, error) {
+		var resp SyntaxCheckBatchResponse
+		if err := s.post("/check_syntax_batch", &SyntaxCheckBatchRequest{batch}, &resp); err != nil {
+			return nil, err
+		}
+		return resp.Results, nil
+	})
+}
+
+// checkSyntaxInBatches splits the sources into batches of up to SYNTAX_CHECK_BATCH_SIZE sources,
+// and fails if any batch fails or returns results of another number.
+func checkSyntaxInBatches(sources []string, check func(batch []string) ([]SyntaxCheckBatchItem, error)) ([]SyntaxCheckBatchItem, error) {
+	items := make([]SyntaxCheckBatchItem, 0, len(sources))
+	for start := 0; start < len(sources); start += SYNTAX_CHECK_BATCH_SIZE {
+		end := start + SYNTAX_CHECK_BATCH_SIZE
+		if end > len(sources) {
+			end = len(sources)
+		}
+
+		results, err := check(sources[start:end])
+		if err != nil {
+			return nil, err
+		}
+		if len(results) != end-start {
+			return nil, fmt.Errorf("syntax checker returned %d results for %d sources", len(results), end-start)
+		}
+		items = append(items, results...)
+	}
+	return items, nil
+}
+
+func (s *SyntaxChecker) post(path string, body interface{}, result interface{}) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
 
 	log.Infof(s.ctx, "request body: %s", string(reqBody))
 
-	req, err := http.NewRequest("POST", s.BaseUrl+"/check_syntax", strings.NewReader(string(reqBody)))
+	req, err := http.NewRequest("POST", s.BaseUrl+path, bytes.NewReader(reqBody))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	req.Header.Add("Content-Type", "application/json")
 
@@ -65,14 +143,12 @@ func (s *SyntaxChecker) CheckSyntax(source string) (*SyntaxCheckResult, error) {
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Criticalf(s.ctx, "failed to request to syntax checker: err=%s", err)
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	var result SyntaxCheckResult
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("syntax checker returned status %d for %s", resp.StatusCode, path)
 	}
-
-	return &result, nil
+	return json.NewDecoder(resp.Body).Decode(result)
 }
@@ -0,0 +1,92 @@
+package indexer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSyntaxCheckResult(t *testing.T) {
+	tests := []struct {
+		body            string
+		hasValidDiagram bool
+		elements        int
+		errorMessage    string
+	}{
+		{`{"valid": true, "diagramType": "SEQUENCE", "description": "(2 participants)", "elementCount": 2}`, true, 2, ""},
+		{`{"valid": true, "diagramType": "SEQUENCE", "description": "(0 participants)", "elementCount": 0}`, false, 0, ""},
+		// older checkers don't count elements
+		{`{"valid": true, "diagramType": "CLASS", "description": "(2 entities)"}`, true, -1, ""},
+		{`{"valid": false, "diagramType": "", "description": "", "errorLine": 3, "errors": ["Syntax Error?"], "suggestions": ["Did you mean: class"]}`, true, -1, "line 3: Syntax Error?"},
+	}
+	for _, test := range tests {
+		var result SyntaxCheckResult
+		if err := json.Unmarshal([]byte(test.body), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.HasValidDiagram() != test.hasValidDiagram {
+			t.Errorf("expected HasValidDiagram %t for %s", test.hasValidDiagram, test.body)
+		}
+		if result.Elements() != test.elements {
+			t.Errorf("expected %d elements for %s, but got %d", test.elements, test.body, result.Elements())
+		}
+		if result.ErrorMessage() != test.errorMessage {
+			t.Errorf("expected %q for %s, but got %q", test.errorMessage, test.body, result.ErrorMessage())
+		}
+	}
+}
+
+func TestCheckSyntaxInBatches(t *testing.T) {
+	sources := make([]string, 2*SYNTAX_CHECK_BATCH_SIZE+1)
+	for i := range sources {
+		sources[i] = fmt.Sprintf("@startuml\nA -> B%d\n@enduml", i)
+	}
+
+	var sizes []int
+	items, err := checkSyntaxInBatches(sources, func(batch []string) ([]SyntaxCheckBatchItem, error) {
+		sizes = append(sizes, len(batch))
+		items := make([]SyntaxCheckBatchItem, len(batch))
+		for i, source := range batch {
+			items[i] = SyntaxCheckBatchItem{Result: &SyntaxCheckResult{Description: source}}
+		}
+		return items, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sizes) != fmt.Sprint([]int{SYNTAX_CHECK_BATCH_SIZE, SYNTAX_CHECK_BATCH_SIZE, 1}) {
+		t.Errorf("not expected batch sizes: got=%v", sizes)
+	}
+	if len(items) != len(sources) {
+		t.Fatalf("not expected items: got=%d, expected=%d", len(items), len(sources))
+	}
+	for i, item := range items {
+		if item.Result.Description != sources[i] {
+			t.Errorf("not expected item %d: got=%s, expected=%s", i, item.Result.Description, sources[i])
+		}
+	}
+
+	// a failure of any batch fails the whole, as well as results of another number
+	calls := 0
+	_, err = checkSyntaxInBatches(sources, func(batch []string) ([]SyntaxCheckBatchItem, error) {
+		calls++
+		if calls == 2 {
+			return nil, errors.New("unavailable")
+		}
+		return make([]SyntaxCheckBatchItem, len(batch)), nil
+	})
+	if err == nil || calls != 2 {
+		t.Errorf("failed batch should fail: calls=%d, err=%v", calls, err)
+	}
+	_, err = checkSyntaxInBatches(sources[:2], func(batch []string) ([]SyntaxCheckBatchItem, error) {
+		return make([]SyntaxCheckBatchItem, 1), nil
+	})
+	if err == nil {
+		t.Errorf("results of another number should fail")
+	}
+
+	if items, err := checkSyntaxInBatches(nil, nil); err != nil || len(items) != 0 {
+		t.Errorf("no sources should not be sent: items=%v, err=%v", items, err)
+	}
+}
@@ -0,0 +1,140 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	pngpkg "image/png"
+
+	"github.com/yfuruyama/real-world-plantuml/blobstore"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// THUMBNAIL_SIZES are the sizes of the box which thumbnails fit in, for the listing of the web
+// and for high density displays. Keep in sync with the web.
+var THUMBNAIL_SIZES = []int{200, 400}
+
+type UmlThumbnail struct {
+	Size int    `datastore:"size,noindex"`
+	Ref  string `datastore:"ref,noindex"`
+}
+
+// makeThumbnail scales down the image to fit in the box of the size by averaging pixels.
+// Images smaller than the box are not scaled up.
+func makeThumbnail(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	thumbWidth, thumbHeight := width, height
+	if width > size || height > size {
+		if width >= height {
+			thumbWidth, thumbHeight = size, height*size/width
+		} else {
+			thumbWidth, thumbHeight = width*size/height, size
+		}
+	}
+	if thumbWidth < 1 {
+		thumbWidth = 1
+	}
+	if thumbHeight < 1 {
+		thumbHeight = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		y0 := bounds.Min.Y + y*height/thumbHeight
+		y1 := bounds.Min.Y + (y+1)*height/thumbHeight
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < thumbWidth; x++ {
+			x0 := bounds.Min.X + x*width/thumbWidth
+			x1 := bounds.Min.X + (x+1)*width/thumbWidth
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			// colors are premultiplied by alpha, so transparent pixels don't darken the average
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// putUmlThumbnails stores thumbnails of the PNG in every size, and sets their refs to the Uml.
+func putUmlThumbnails(ctx context.Context, blobs blobstore.Store, uml *Uml, png []byte) error {
+	src, err := pngpkg.Decode(bytes.NewReader(png))
+	if err != nil {
+		return err
+	}
+
+	thumbnails := make([]UmlThumbnail, 0, len(THUMBNAIL_SIZES))
+	for _, size := range THUMBNAIL_SIZES {
+		var buf bytes.Buffer
+		if err := pngpkg.Encode(&buf, makeThumbnail(src, size)); err != nil {
+			return err
+		}
+		ref, err := blobs.Put(ctx, buf.Bytes(), "image/png")
+		if err != nil {
+			return err
+		}
+		thumbnails = append(thumbnails, UmlThumbnail{Size: size, Ref: ref})
+	}
+	uml.Thumbnails = thumbnails
+	return nil
+}
+
+func hasAllThumbnails(uml *Uml) bool {
+	sizes := make(map[int]bool)
+	for _, thumbnail := range uml.Thumbnails {
+		sizes[thumbnail.Size] = true
+	}
+	for _, size := range THUMBNAIL_SIZES {
+		if !sizes[size] {
+			return false
+		}
+	}
+	return true
+}
+
+// makeUmlThumbnails makes thumbnails of a Uml which is indexed before thumbnails, or before a size is added.
+func makeUmlThumbnails(ctx context.Context, run *MigrationRun, key *datastore.Key) (bool, error) {
+	var uml Uml
+	if err := datastore.Get(ctx, key, &uml); err != nil {
+		return false, err
+	}
+	// inline ones get thumbnails by the "uml-blobs" migration
+	if uml.PngRef == "" || hasAllThumbnails(&uml) {
+		return false, nil
+	}
+
+	blobs, err := blobstore.NewFromEnv(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer blobs.Close()
+	png, err := blobs.Get(ctx, uml.PngRef)
+	if err != nil {
+		return false, err
+	}
+	if err := putUmlThumbnails(ctx, blobs, &uml, png); err != nil {
+		return false, err
+	}
+
+	if _, err := datastore.Put(ctx, key, &uml); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,56 @@
+package indexer
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestMakeThumbnail(t *testing.T) {
+	// left half is black and right half is white
+	src := image.NewNRGBA(image.Rect(0, 0, 800, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 800; x++ {
+			if x >= 400 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	thumbnail := makeThumbnail(src, 200)
+	if bounds := thumbnail.Bounds(); bounds.Dx() != 200 || bounds.Dy() != 100 {
+		t.Fatalf("expected 200x100, but got %dx%d", bounds.Dx(), bounds.Dy())
+	}
+	if r, _, _, _ := thumbnail.At(0, 0).RGBA(); r != 0 {
+		t.Errorf("expected black, but got %d", r)
+	}
+	if r, _, _, _ := thumbnail.At(199, 99).RGBA(); r != 0xffff {
+		t.Errorf("expected white, but got %d", r)
+	}
+
+	small := image.NewNRGBA(image.Rect(0, 0, 50, 120))
+	if bounds := makeThumbnail(small, 200).Bounds(); bounds.Dx() != 50 || bounds.Dy() != 120 {
+		t.Errorf("small images must not be scaled up, but got %dx%d", bounds.Dx(), bounds.Dy())
+	}
+
+	tall := image.NewNRGBA(image.Rect(0, 0, 10, 4000))
+	if bounds := makeThumbnail(tall, 200).Bounds(); bounds.Dx() != 1 || bounds.Dy() != 200 {
+		t.Errorf("expected 1x200, but got %dx%d", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestHasAllThumbnails(t *testing.T) {
+	uml := &Uml{Thumbnails: []UmlThumbnail{{Size: THUMBNAIL_SIZES[0], Ref: "a"}}}
+	if hasAllThumbnails(uml) {
+		t.Errorf("thumbnails of other sizes are missing")
+	}
+	uml.Thumbnails = nil
+	for _, size := range THUMBNAIL_SIZES {
+		uml.Thumbnails = append(uml.Thumbnails, UmlThumbnail{Size: size, Ref: "a"})
+	}
+	if !hasAllThumbnails(uml) {
+		t.Errorf("expected all thumbnails")
+	}
+}
@@ -0,0 +1,230 @@
+// Package svgsanitizer rewrites SVG of PlantUML with allowed elements and attributes only,
+// which the indexer applies before storing it and the web applies again for diagrams indexed before it.
+package svgsanitizer
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrNotSvg = errors.New("not an svg document")
+
+// allowedSvgElements are what PlantUML outputs. The others, such as script, foreignObject and style,
+// are dropped with their children.
+var allowedSvgElements = map[string]bool{
+	"svg": true, "g": true, "defs": true, "title": true, "desc": true, "symbol": true, "use": true,
+	"rect": true, "circle": true, "ellipse": true, "line": true, "polyline": true, "polygon": true, "path": true,
+	"text": true, "tspan": true, "textPath": true, "a": true, "image": true,
+	"linearGradient": true, "radialGradient": true, "stop": true,
+	"marker": true, "clipPath": true, "mask": true, "pattern": true,
+	"filter": true, "feBlend": true, "feColorMatrix": true, "feComponentTransfer": true, "feComposite": true,
+	"feDropShadow": true, "feFlood": true, "feFuncA": true, "feFuncB": true, "feFuncG": true, "feFuncR": true,
+	"feGaussianBlur": true, "feMerge": true, "feMergeNode": true, "feMorphology": true, "feOffset": true,
+}
+
+// allowedSvgAttributes are presentation and geometry attributes. Event handlers (on*) are not allowed.
+var allowedSvgAttributes = map[string]bool{
+	"xmlns": true, "xmlns:xlink": true, "xml:space": true, "version": true, "zoomAndPan": true, "contentStyleType": true,
+	"id": true, "class": true, "style": true, "transform": true, "title": true,
+	"x": true, "y": true, "x1": true, "x2": true, "y1": true, "y2": true, "cx": true, "cy": true, "r": true, "rx": true, "ry": true,
+	"dx": true, "dy": true, "width": true, "height": true, "d": true, "points": true, "viewBox": true, "preserveAspectRatio": true,
+	"fill": true, "fill-opacity": true, "fill-rule": true, "opacity": true, "visibility": true, "display": true,
+	"stroke": true, "stroke-width": true, "stroke-dasharray": true, "stroke-dashoffset": true, "stroke-linecap": true,
+	"stroke-linejoin": true, "stroke-miterlimit": true, "stroke-opacity": true,
+	"font-family": true, "font-size": true, "font-style": true, "font-weight": true, "text-anchor": true, "text-decoration": true,
+	"dominant-baseline": true, "alignment-baseline": true, "baseline-shift": true, "lengthAdjust": true, "textLength": true, "rotate": true,
+	"filter": true, "clip-path": true, "clip-rule": true, "mask": true,
+	"marker-start": true, "marker-mid": true, "marker-end": true, "markerWidth": true, "markerHeight": true, "markerUnits": true,
+	"refX": true, "refY": true, "orient": true,
+	"gradientUnits": true, "gradientTransform": true, "spreadMethod": true, "offset": true, "stop-color": true, "stop-opacity": true,
+	"fx": true, "fy": true, "patternUnits": true, "patternContentUnits": true, "patternTransform": true, "clipPathUnits": true,
+	"maskUnits": true, "maskContentUnits": true, "filterUnits": true, "primitiveUnits": true,
+	"in": true, "in2": true, "result": true, "stdDeviation": true, "type": true, "values": true, "mode": true,
+	"operator": true, "k1": true, "k2": true, "k3": true, "k4": true, "flood-color": true, "flood-opacity": true, "radius": true,
+	"tableValues": true, "slope": true, "intercept": true, "amplitude": true, "exponent": true,
+	"href": true, "xlink:href": true, "xlink:title": true, "xlink:actuate": true, "xlink:show": true, "xlink:type": true, "target": true,
+}
+
+var unsafeCssPatterns = []string{"expression(", "javascript:", "vbscript:", "@import", "behavior:", "-moz-binding"}
+
+var svgTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+var svgAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// Sanitize rewrites the SVG with allowed elements and attributes only, so that it can be inlined in pages.
+// Comments, doctypes and processing instructions other than the XML declaration are dropped as well.
+func Sanitize(svg []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	decoder := xml.NewDecoder(bytes.NewReader(svg))
+	decoder.Entity = xml.HTMLEntity
+
+	// names of the open elements, because RawToken doesn't check that end elements match
+	var stack []string
+	// depth in a dropped element
+	skipping := 0
+	// the start tag is left open, so that an empty element can be closed by "/>"
+	open := false
+	closeStart := func() {
+		if open {
+			buf.WriteString(">")
+			open = false
+		}
+	}
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if skipping > 0 {
+				skipping++
+				continue
+			}
+			name := QualifiedName(t.Name)
+			if len(stack) == 0 && name != "svg" {
+				return nil, ErrNotSvg
+			}
+			if !allowedSvgElements[name] {
+				skipping = 1
+				continue
+			}
+			closeStart()
+			buf.WriteString("<" + name)
+			for _, attr := range t.Attr {
+				attrName := QualifiedName(attr.Name)
+				if !isSafeSvgAttribute(name, attrName, attr.Value) {
+					continue
+				}
+				fmt.Fprintf(&buf, ` %s="%s"`, attrName, svgAttrEscaper.Replace(attr.Value))
+			}
+			open = true
+			stack = append(stack, name)
+		case xml.EndElement:
+			if skipping > 0 {
+				skipping--
+				continue
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("unexpected end element %s", QualifiedName(t.Name))
+			}
+			name := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if open {
+				buf.WriteString("/>")
+				open = false
+			} else {
+				buf.WriteString("</" + name + ">")
+			}
+		case xml.CharData:
+			if skipping > 0 || len(stack) == 0 {
+				continue
+			}
+			closeStart()
+			buf.WriteString(svgTextEscaper.Replace(string(t)))
+		case xml.ProcInst:
+			if t.Target == "xml" && buf.Len() == 0 {
+				fmt.Fprintf(&buf, "<?xml %s?>", t.Inst)
+			}
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("unclosed element %s", stack[len(stack)-1])
+	}
+	if buf.Len() == 0 {
+		return nil, ErrNotSvg
+	}
+	return buf.Bytes(), nil
+}
+
+// EscapeText escapes the character data of an element.
+func EscapeText(text string) string {
+	return svgTextEscaper.Replace(text)
+}
+
+// EscapeAttr escapes the value of an attribute quoted by '"'.
+func EscapeAttr(value string) string {
+	return svgAttrEscaper.Replace(value)
+}
+
+// QualifiedName returns the name with the prefix of RawToken, such as "xlink:href".
+func QualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+func isSafeSvgAttribute(element, name, value string) bool {
+	if !allowedSvgAttributes[name] {
+		return false
+	}
+	if name == "href" || name == "xlink:href" {
+		return isSafeSvgUrl(element, value)
+	}
+	return isSafeCss(value)
+}
+
+// isSafeCss rejects values which may run scripts or load external resources,
+// such as url() other than references to elements in the document.
+// Values with backslashes are rejected as well, because CSS escapes such as "\75rl(" hide the patterns.
+func isSafeCss(value string) bool {
+	if strings.Contains(value, `\`) {
+		return false
+	}
+	normalized := strings.ToLower(strings.Join(strings.Fields(value), ""))
+	for _, pattern := range unsafeCssPatterns {
+		if strings.Contains(normalized, pattern) {
+			return false
+		}
+	}
+	for rest := normalized; ; {
+		i := strings.Index(rest, "url(")
+		if i < 0 {
+			return true
+		}
+		rest = strings.TrimLeft(rest[i+len("url("):], `"'`)
+		if !strings.HasPrefix(rest, "#") {
+			return false
+		}
+	}
+}
+
+// isSafeSvgUrl allows links to web pages and references in the document.
+// Images may be embedded as raster data URLs.
+func isSafeSvgUrl(element, value string) bool {
+	// browsers ignore whitespace and control characters in schemes, such as "java\tscript:"
+	normalized := strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value))
+
+	if element == "image" {
+		for _, prefix := range []string{"data:image/png;", "data:image/jpeg;", "data:image/gif;"} {
+			if strings.HasPrefix(normalized, prefix) {
+				return true
+			}
+		}
+	}
+
+	i := strings.IndexAny(normalized, ":/?#")
+	if i < 0 || normalized[i] != ':' {
+		// relative or fragment
+		return true
+	}
+	switch normalized[:i] {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package svgsanitizer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		svg      string
+		expected string
+	}{
+		{
+			`<?xml version="1.0" encoding="UTF-8" standalone="no"?><!-- comment --><svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" contentScriptType="application/ecmascript" viewBox="0 0 10 10"><g><rect fill="#FEFECE" filter="url(#f1)" x="1"/><text x="2">A &amp; B</text></g></svg>`,
+			`<?xml version="1.0" encoding="UTF-8" standalone="no"?><svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 10 10"><g><rect fill="#FEFECE" filter="url(#f1)" x="1"/><text x="2">A &amp; B</text></g></svg>`,
+		},
+		{
+			`<svg onload="alert(1)"><script>alert(1)</script><foreignObject><div><script>alert(2)</script></div></foreignObject><rect onclick="alert(3)" x="1"/></svg>`,
+			`<svg><rect x="1"/></svg>`,
+		},
+		{
+			`<svg><a xlink:href="javascript:alert(1)"><text>a</text></a><a href="  JaVa&#x09;Script:alert(1)"/><a xlink:href="https://github.com/" target="_top"/></svg>`,
+			`<svg><a><text>a</text></a><a/><a xlink:href="https://github.com/" target="_top"/></svg>`,
+		},
+		{
+			`<svg><rect style="fill: url(http://example.com/x.svg#a)"/><rect style="background: expression(alert(1))"/><rect style="stroke: #A80036;"/></svg>`,
+			`<svg><rect/><rect/><rect style="stroke: #A80036;"/></svg>`,
+		},
+		{
+			`<svg><rect style="fill: \75rl(http://example.com/x.svg#a)"/><rect fill="u\rl(//example.com/x.svg#a)"/></svg>`,
+			`<svg><rect/><rect/></svg>`,
+		},
+		{
+			`<svg><image xlink:href="data:image/png;base64,AAAA"/><image xlink:href="data:image/svg+xml;base64,AAAA"/></svg>`,
+			`<svg><image xlink:href="data:image/png;base64,AAAA"/><image/></svg>`,
+		},
+	}
+	for _, test := range tests {
+		sanitized, err := Sanitize([]byte(test.svg))
+		if err != nil {
+			t.Errorf("failed to sanitize %s: %s", test.svg, err)
+			continue
+		}
+		if string(sanitized) != test.expected {
+			t.Errorf("expected %s, but got %s", test.expected, sanitized)
+		}
+	}
+
+	for _, svg := range []string{`<html><body/></html>`, `<svg><g></svg>`, ``} {
+		if _, err := Sanitize([]byte(svg)); err == nil {
+			t.Errorf("expected an error for %q", svg)
+		}
+	}
+}
+
+func TestSanitizeIsIdempotent(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"><defs><filter id="f"><feOffset dx="4.0"/></filter></defs><text>&lt;&lt;actor&gt;&gt; "quoted"</text></svg>`
+	once, err := Sanitize([]byte(svg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := Sanitize(once)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(once) != string(twice) {
+		t.Errorf("expected %s, but got %s", once, twice)
+	}
+	if !strings.Contains(string(once), "&lt;&lt;actor&gt;&gt;") {
+		t.Errorf("texts must be escaped: %s", once)
+	}
+}
@@ -24,6 +24,7 @@ fun main(args: Array<String>) {
             .register(JacksonFeature::class.java)
             .register(ObjectMapperProvider::class.java)
             .register(CheckSyntaxResource())
+            .register(CheckSyntaxBatchResource())
 
     val server = JettyHttpContainerFactory.createServer(baseUri, config)
     try {
@@ -45,12 +46,41 @@ class ObjectMapperProvider : ContextResolver<ObjectMapper> {
 @JsonIgnoreProperties(ignoreUnknown = true)
 data class CheckSyntaxRequest(val source: String?)
 
-data class CheckSyntaxResponse(val valid: Boolean, val diagramType: String, val description: String)
+data class CheckSyntaxResponse(
+        val valid: Boolean,
+        val diagramType: String,
+        val description: String,
+        // line of the first error starting from 1, or null if valid
+        val errorLine: Int? = null,
+        val errors: List<String> = emptyList(),
+        val suggestions: List<String> = emptyList(),
+        // number of elements such as participants, or null if unknown
+        val elementCount: Int? = null)
+
+// SyntaxChecker returns the description but not the parsed diagram, and PlantUML writes the description
+// from the diagram, like "(3 participants)" for sequence diagrams and "(5 entities)" for class diagrams.
+// So it's the only source of the count, which is null for diagrams whose description has no count.
+val elementCountPattern = Regex("""^\((\d+) .+\)$""")
+
+fun elementCount(description: String?): Int? {
+    if (description == null) {
+        return null
+    }
+    return elementCountPattern.find(description)?.groupValues?.get(1)?.toIntOrNull()
+}
+
+@JsonIgnoreProperties(ignoreUnknown = true)
+data class CheckSyntaxBatchRequest(val sources: List<String>?)
+
+// either result or error is set for each source
+data class CheckSyntaxBatchItem(val result: CheckSyntaxResponse? = null, val error: String? = null)
+
+data class CheckSyntaxBatchResponse(val results: List<CheckSyntaxBatchItem>)
+
+const val MAX_BATCH_SIZE = 100
 
 @Path("check_syntax")
 class CheckSyntaxResource {
-    var logger = Logger.getLogger(CheckSyntaxResource::class.java.name)
-
     @POST
     @Produces(MediaType.APPLICATION_JSON)
     @Consumes(MediaType.APPLICATION_JSON)
@@ -58,16 +88,63 @@ class CheckSyntaxResource {
         if (req.source == null) {
             throw BadRequestException("`source` not specified")
         }
+        return SourceChecker.check(req.source)
+    }
+}
+
+@Path("check_syntax_batch")
+class CheckSyntaxBatchResource {
+    var logger = Logger.getLogger(CheckSyntaxBatchResource::class.java.name)
+
+    @POST
+    @Produces(MediaType.APPLICATION_JSON)
+    @Consumes(MediaType.APPLICATION_JSON)
+    fun checkSyntaxBatch(req: CheckSyntaxBatchRequest): CheckSyntaxBatchResponse {
+        if (req.sources == null) {
+            throw BadRequestException("`sources` not specified")
+        }
+        if (req.sources.size > MAX_BATCH_SIZE) {
+            throw BadRequestException("`sources` exceeds %d".format(MAX_BATCH_SIZE))
+        }
+
+        // a failure of a source doesn't fail the others
+        val results = req.sources.map { source ->
+            try {
+                CheckSyntaxBatchItem(result = SourceChecker.check(source))
+            } catch (e: Exception) {
+                logger.warning("Failed to check syntax: %s".format(e))
+                CheckSyntaxBatchItem(error = e.toString())
+            }
+        }
+        return CheckSyntaxBatchResponse(results)
+    }
+}
+
+object SourceChecker {
+    var logger = Logger.getLogger(SourceChecker::class.java.name)
 
-        logger.info("Get source %s".format(req.source))
-        val result = SyntaxChecker.checkSyntax(req.source)
+    fun check(source: String): CheckSyntaxResponse {
+        logger.info("Get source %s".format(source))
+        val result = SyntaxChecker.checkSyntax(source)
 
         if (result.isError || result.umlDiagramType == null) {
-            logger.info("Invalid syntax: errors=%s".format(result.errors.joinToString(",")))
-            return CheckSyntaxResponse(false, "", "")
+            val errors = result.errors?.toList() ?: emptyList()
+            logger.info("Invalid syntax: errors=%s".format(errors.joinToString(",")))
+            return CheckSyntaxResponse(
+                    valid = false,
+                    diagramType = "",
+                    description = "",
+                    // the position starts from 0
+                    errorLine = if (result.isError) result.errorLinePosition + 1 else null,
+                    errors = errors,
+                    suggestions = result.suggest ?: emptyList())
         } else {
             logger.info("Valid syntax: diagramType=%s, description=%s".format(result.umlDiagramType, result.description))
-            return CheckSyntaxResponse(true, result.umlDiagramType.name, result.description)
+            return CheckSyntaxResponse(
+                    valid = true,
+                    diagramType = result.umlDiagramType.name,
+                    description = result.description,
+                    elementCount = elementCount(result.description))
         }
     }
 }
@@ -0,0 +1,22 @@
+package com.yfuruyama.syntaxchecker
+
+import org.junit.Assert.assertEquals
+import org.junit.Test
+
+class ElementCountTest {
+    @Test
+    fun countsInDescription() {
+        assertEquals(3, elementCount("(3 participants)"))
+        assertEquals(5, elementCount("(5 entities)"))
+        assertEquals(0, elementCount("(0 participants)"))
+    }
+
+    @Test
+    fun unknownCounts() {
+        assertEquals(null, elementCount(null))
+        assertEquals(null, elementCount(""))
+        assertEquals(null, elementCount("activity3"))
+        assertEquals(null, elementCount("(Ditaa)"))
+        assertEquals(null, elementCount("3 participants"))
+    }
+}
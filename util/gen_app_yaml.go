@@ -34,7 +34,7 @@ func main() {
 
 	env := make(map[string]string)
 	for _, e := range os.Environ() {
-		pair := strings.Split(e, "=")
+		pair := strings.SplitN(e, "=", 2)
 		env[pair[0]] = pair[1]
 	}
 
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -16,21 +17,55 @@ import (
 	"google.golang.org/appengine/log"
 )
 
-const NUM_OF_ITEMS_PER_PAGE = 21
+const (
+	NUM_OF_ITEMS_PER_PAGE       = 21
+	DEFAULT_THUMBNAIL_SIZE      = 200
+	DEFAULT_PLANTUML_SERVER_URL = "https://www.plantuml.com/plantuml"
+)
 
 type CommonTemplateVars struct {
 	GATrackingID string
 	Context      context.Context
 	DiagramType  DiagramType
 	Query        string
+	// Section is the selected section other than diagram types, such as "invalid"
+	Section string
 }
 
 type UmlListTemplateVars struct {
 	*CommonTemplateVars
+	Umls          []*Uml
+	NextCursor    string
+	ThumbnailSize int
+}
+
+type UmlContentResponseBody struct {
+	ID     int64  `json:"id"`
+	Svg    string `json:"svg"`
+	Source string `json:"source"`
+}
+
+type InvalidUmlListTemplateVars struct {
+	*CommonTemplateVars
+	Categories  []InvalidUmlCategory
+	Category    InvalidUmlCategory
+	InvalidUmls []*InvalidUml
+	NextCursor  string
+}
+
+type UnknownUmlListTemplateVars struct {
+	*CommonTemplateVars
+	Counts     []SyntaxTypeCount
+	SyntaxType string
 	Umls       []*Uml
 	NextCursor string
 }
 
+type InvalidUmlsResponseBody struct {
+	InvalidUmls []*InvalidUml `json:"invalidUmls"`
+	NextCursor  string        `json:"nextCursor,omitempty"`
+}
+
 type Handler struct {
 	GATrackingID string
 	FuncMap      template.FuncMap
@@ -65,9 +100,6 @@ func NewHandler(gaTrackingID string) *Handler {
 		"safehtml": func(text string) template.HTML {
 			return template.HTML(text)
 		},
-		"loopLineTimes": func(text string) []struct{} {
-			return make([]struct{}, strings.Count(text, "\n")+1)
-		},
 		"githubUrlToAnchorText": func(url string) string {
 			re := regexp.MustCompile(`^https://github.com/([^/]+)/([^/]+)/(.+)/(.+)$`)
 			matched := re.FindStringSubmatch(url)
@@ -89,15 +121,15 @@ func NewHandler(gaTrackingID string) *Handler {
 		"staticPath": func(ctx context.Context, filePath string) string {
 			return fmt.Sprintf("/static/%s?v=%s", filePath, os.Getenv("GAE_VERSION"))
 		},
-		"highlight": func(word, code string) string {
-			if word == "" {
-				return code
-			}
-			re, err := regexp.Compile(fmt.Sprintf("(?i)(%s)", word))
-			if err != nil {
-				return code
+		"plantUmlEditUrl": func(encodedId string) string {
+			serverUrl := os.Getenv("PLANTUML_SERVER_URL")
+			if serverUrl == "" {
+				serverUrl = DEFAULT_PLANTUML_SERVER_URL
 			}
-			return re.ReplaceAllString(code, "<mark>$1</mark>")
+			return fmt.Sprintf("%s/uml/%s", serverUrl, encodedId)
+		},
+		"downloadFormats": func() []RenderFormat {
+			return DownloadFormats
 		},
 		"toUpperCase": func(word string) string {
 			return strings.ToUpper(word)
@@ -140,8 +172,9 @@ func (h *Handler) GetIndex(w http.ResponseWriter, r *http.Request) error {
 			Context:      ctx,
 			DiagramType:  typ,
 		},
-		Umls:       umls,
-		NextCursor: nextCursor,
+		Umls:          umls,
+		NextCursor:    nextCursor,
+		ThumbnailSize: thumbnailSize(r),
 	})
 	if err != nil {
 		return err
@@ -179,8 +212,9 @@ func (h *Handler) GetSearch(w http.ResponseWriter, r *http.Request) error {
 			Context:      ctx,
 			Query:        query,
 		},
-		Umls:       umls,
-		NextCursor: nextCursor,
+		Umls:          umls,
+		NextCursor:    nextCursor,
+		ThumbnailSize: thumbnailSize(r),
 	})
 	if err != nil {
 		return err
@@ -223,6 +257,195 @@ func (h *Handler) GetUml(w http.ResponseWriter, r *http.Request) error {
 			Context:      ctx,
 			DiagramType:  "",
 		},
+		Umls:          umls,
+		NextCursor:    nextCursor,
+		ThumbnailSize: thumbnailSize(r),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (h *Handler) GetUmlDownload(w http.ResponseWriter, r *http.Request) error {
+	ctx := appengine.NewContext(r)
+	umlID, _ := strconv.ParseInt(chi.URLParam(r, "umlID"), 10, 64)
+	format := RenderFormat(chi.URLParam(r, "format"))
+	if !format.IsValid() {
+		return h.NotFound(w, r)
+	}
+
+	uml, err := FetchUmlById(ctx, umlID)
+	if err != nil {
+		return err
+	}
+	if uml == nil {
+		return h.NotFound(w, r)
+	}
+
+	data, err := FetchRendering(ctx, uml, format)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", format.FileName(uml.ID)))
+	w.Write(data)
+	return nil
+}
+
+func (h *Handler) GetUmlThumbnail(w http.ResponseWriter, r *http.Request) error {
+	ctx := appengine.NewContext(r)
+	umlID, _ := strconv.ParseInt(chi.URLParam(r, "umlID"), 10, 64)
+
+	uml, err := FetchUmlById(ctx, umlID)
+	if err != nil {
+		return err
+	}
+	if uml == nil {
+		return h.NotFound(w, r)
+	}
+
+	var data []byte
+	if ref := uml.Thumbnail(thumbnailSize(r)); ref != "" {
+		data, err = fetchBlob(ctx, ref)
+	} else {
+		// not made yet, then the PNG is scaled by the browser
+		data, err = uml.Png(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data)
+	return nil
+}
+
+// GetUmlContent returns the SVG and the source, which are loaded when the modal is opened.
+func (h *Handler) GetUmlContent(w http.ResponseWriter, r *http.Request) error {
+	ctx := appengine.NewContext(r)
+	umlID, _ := strconv.ParseInt(chi.URLParam(r, "umlID"), 10, 64)
+
+	uml, err := FetchUmlById(ctx, umlID)
+	if err != nil {
+		return err
+	}
+	if uml == nil {
+		return h.NotFound(w, r)
+	}
+	if err := uml.LoadSvg(ctx); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(UmlContentResponseBody{
+		ID:     uml.ID,
+		Svg:    uml.Svg,
+		Source: uml.Source,
+	})
+}
+
+// GetInvalidUmls lists diagrams which PlantUML can't draw, with their errors.
+func (h *Handler) GetInvalidUmls(w http.ResponseWriter, r *http.Request) error {
+	ctx := appengine.NewContext(r)
+
+	queryParams := r.URL.Query()
+	category := InvalidUmlCategory(queryParams.Get("category"))
+	if category != "" && !category.IsValid() {
+		return h.NotFound(w, r)
+	}
+	cursor := queryParams.Get("cursor")
+
+	invalidUmls, nextCursor, err := FetchInvalidUmls(ctx, category, NUM_OF_ITEMS_PER_PAGE, cursor)
+	if err != nil {
+		return err
+	}
+
+	tmpl := template.Must(template.New("").Funcs(h.FuncMap).ParseFiles(
+		"templates/base.html",
+		"templates/invalid.html",
+	))
+
+	err = tmpl.ExecuteTemplate(w, "base", InvalidUmlListTemplateVars{
+		CommonTemplateVars: &CommonTemplateVars{
+			GATrackingID: h.GATrackingID,
+			Context:      ctx,
+			Section:      "invalid",
+		},
+		Categories:  InvalidUmlCategories,
+		Category:    category,
+		InvalidUmls: invalidUmls,
+		NextCursor:  nextCursor,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetInvalidUmlsApi is the JSON version of GetInvalidUmls.
+func (h *Handler) GetInvalidUmlsApi(w http.ResponseWriter, r *http.Request) error {
+	ctx := appengine.NewContext(r)
+
+	queryParams := r.URL.Query()
+	category := InvalidUmlCategory(queryParams.Get("category"))
+	if category != "" && !category.IsValid() {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unknown category: %s", category)
+		return nil
+	}
+	cursor := queryParams.Get("cursor")
+
+	invalidUmls, nextCursor, err := FetchInvalidUmls(ctx, category, NUM_OF_ITEMS_PER_PAGE, cursor)
+	if err != nil {
+		return err
+	}
+	if invalidUmls == nil {
+		invalidUmls = []*InvalidUml{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(InvalidUmlsResponseBody{
+		InvalidUmls: invalidUmls,
+		NextCursor:  nextCursor,
+	})
+}
+
+// GetAdminUnknownUmls lists umls which the indexer can't classify, with the types of the syntax checker
+// to improve the classifier.
+func (h *Handler) GetAdminUnknownUmls(w http.ResponseWriter, r *http.Request) error {
+	ctx := appengine.NewContext(r)
+
+	queryParams := r.URL.Query()
+	syntaxType := queryParams.Get("syntaxType")
+	cursor := queryParams.Get("cursor")
+
+	counts, err := CountUnknownUmls(ctx)
+	if err != nil {
+		return err
+	}
+	umls, nextCursor, err := FetchUnknownUmls(ctx, syntaxType, NUM_OF_ITEMS_PER_PAGE, cursor)
+	if err != nil {
+		return err
+	}
+
+	tmpl := template.Must(template.New("").Funcs(h.FuncMap).ParseFiles(
+		"templates/base.html",
+		"templates/admin_unknown.html",
+	))
+
+	err = tmpl.ExecuteTemplate(w, "base", UnknownUmlListTemplateVars{
+		CommonTemplateVars: &CommonTemplateVars{
+			GATrackingID: h.GATrackingID,
+			Context:      ctx,
+			DiagramType:  TypeOther,
+		},
+		Counts:     counts,
+		SyntaxType: syntaxType,
 		Umls:       umls,
 		NextCursor: nextCursor,
 	})
@@ -233,6 +456,17 @@ func (h *Handler) GetUml(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// thumbnailSize returns the size in the query if it's one of ThumbnailSizes.
+func thumbnailSize(r *http.Request) int {
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+	for _, s := range ThumbnailSizes {
+		if s == size {
+			return size
+		}
+	}
+	return DEFAULT_THUMBNAIL_SIZE
+}
+
 func (h *Handler) NotFound(w http.ResponseWriter, r *http.Request) error {
 	ctx := appengine.NewContext(r)
 	w.WriteHeader(http.StatusNotFound)
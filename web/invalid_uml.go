@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+type InvalidUmlCategory string
+
+const (
+	InvalidSyntax  InvalidUmlCategory = "syntax"
+	InvalidInclude InvalidUmlCategory = "include"
+	InvalidEmpty   InvalidUmlCategory = "empty"
+	InvalidRender  InvalidUmlCategory = "render"
+	InvalidOther   InvalidUmlCategory = "other"
+)
+
+var InvalidUmlCategories = []InvalidUmlCategory{InvalidSyntax, InvalidInclude, InvalidEmpty, InvalidRender, InvalidOther}
+
+func (c InvalidUmlCategory) IsValid() bool {
+	for _, category := range InvalidUmlCategories {
+		if category == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c InvalidUmlCategory) ToHumanString() string {
+	switch c {
+	case InvalidSyntax:
+		return "Syntax error"
+	case InvalidInclude:
+		return "Include error"
+	case InvalidEmpty:
+		return "No diagram"
+	case InvalidRender:
+		return "Render error"
+	default:
+		return "Other"
+	}
+}
+
+// InvalidUml is a source which PlantUML can't draw, which is stored by the indexer.
+type InvalidUml struct {
+	ID           string             `datastore:"-" json:"id"`
+	GitHubUrl    string             `datastore:"gitHubUrl" json:"gitHubUrl"`
+	Source       string             `datastore:"source,noindex" json:"source"`
+	SourceSHA256 string             `datastore:"sourceSHA256" json:"sourceSHA256"`
+	EncodedId    string             `datastore:"encodedId,noindex" json:"encodedId,omitempty"`
+	Category     InvalidUmlCategory `datastore:"category" json:"category"`
+	// ErrorLine is the line of the first error starting from 1, or 0 if it's unknown
+	ErrorLine   int       `datastore:"errorLine,noindex" json:"errorLine,omitempty"`
+	Errors      []string  `datastore:"errors,noindex" json:"errors"`
+	Suggestions []string  `datastore:"suggestions,noindex" json:"suggestions"`
+	Tags        []string  `datastore:"tags" json:"tags"`
+	CreatedAt   time.Time `datastore:"createdAt" json:"createdAt"`
+}
+
+type SourceLine struct {
+	Number  int
+	Text    string
+	IsError bool
+}
+
+// SourceLines splits the source to show the line of the error.
+func (u *InvalidUml) SourceLines() []SourceLine {
+	lines := strings.Split(u.Source, "\n")
+	sourceLines := make([]SourceLine, len(lines))
+	for i, line := range lines {
+		sourceLines[i] = SourceLine{
+			Number:  i + 1,
+			Text:    line,
+			IsError: i+1 == u.ErrorLine,
+		}
+	}
+	return sourceLines
+}
+
+// FetchInvalidUmls returns invalid umls of the category, or of every category if it's empty.
+func FetchInvalidUmls(ctx context.Context, category InvalidUmlCategory, count int, cursor string) ([]*InvalidUml, string, error) {
+	q := datastore.NewQuery("InvalidUml").Limit(count)
+	if category != "" {
+		q = q.Filter("category =", category)
+	}
+	if cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err == nil {
+			q = q.Start(decoded)
+		}
+	}
+
+	iter := q.Run(ctx)
+	var umls []*InvalidUml
+	for {
+		var uml InvalidUml
+		key, err := iter.Next(&uml)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			log.Criticalf(ctx, "datastore fetch error: %v", err)
+			return nil, "", err
+		}
+		uml.ID = key.StringID()
+		umls = append(umls, &uml)
+	}
+
+	var nextCursor string
+	if len(umls) == count {
+		if dsCursor, err := iter.Cursor(); err == nil {
+			nextCursor = dsCursor.String()
+		}
+	}
+	return umls, nextCursor, nil
+}
@@ -18,6 +18,12 @@ func main() {
 	router.Get("/", handler.ToHandlerFunc(handler.GetIndex))
 	router.Get("/search", handler.ToHandlerFunc(handler.GetSearch))
 	router.Get("/umls/{umlID:\\d+}", handler.ToHandlerFunc(handler.GetUml))
+	router.Get("/umls/{umlID:\\d+}/download/{format}", handler.ToHandlerFunc(handler.GetUmlDownload))
+	router.Get("/umls/{umlID:\\d+}/thumbnail", handler.ToHandlerFunc(handler.GetUmlThumbnail))
+	router.Get("/umls/{umlID:\\d+}/content", handler.ToHandlerFunc(handler.GetUmlContent))
+	router.Get("/invalid", handler.ToHandlerFunc(handler.GetInvalidUmls))
+	router.Get("/api/invalid_umls", handler.ToHandlerFunc(handler.GetInvalidUmlsApi))
+	router.Get("/admin/unknown", handler.ToHandlerFunc(handler.GetAdminUnknownUmls))
 	router.NotFound(handler.ToHandlerFunc(handler.NotFound))
 
 	// for debugging
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	INDEXER_SERVICE = "indexer"
+	// RENDERING_REQUEST_TIMEOUT covers the deadline of the indexer for PDF, which is the longest
+	RENDERING_REQUEST_TIMEOUT = 90 * time.Second
+)
+
+type RenderFormat string
+
+const (
+	FormatSvg     RenderFormat = "svg"
+	FormatPng     RenderFormat = "png"
+	FormatAscii   RenderFormat = "txt"
+	FormatUnicode RenderFormat = "utxt"
+	FormatPdf     RenderFormat = "pdf"
+	FormatEps     RenderFormat = "eps"
+	FormatLatex   RenderFormat = "latex"
+)
+
+// DownloadFormats are offered in the modal. SVG, PNG and ASCII are stored in Uml,
+// and the others are rendered on the first download.
+var DownloadFormats = []RenderFormat{FormatSvg, FormatPng, FormatPdf, FormatEps, FormatLatex, FormatAscii, FormatUnicode}
+
+var renderFormatContentTypes = map[RenderFormat]string{
+	FormatSvg:     "image/svg+xml",
+	FormatPng:     "image/png",
+	FormatAscii:   "text/plain; charset=utf-8",
+	FormatUnicode: "text/plain; charset=utf-8",
+	FormatPdf:     "application/pdf",
+	FormatEps:     "application/postscript",
+	FormatLatex:   "application/x-latex",
+}
+
+var renderFormatExtensions = map[RenderFormat]string{
+	FormatSvg:     "svg",
+	FormatPng:     "png",
+	FormatAscii:   "txt",
+	FormatUnicode: "utxt.txt",
+	FormatPdf:     "pdf",
+	FormatEps:     "eps",
+	FormatLatex:   "tex",
+}
+
+func (f RenderFormat) IsValid() bool {
+	_, ok := renderFormatContentTypes[f]
+	return ok
+}
+
+func (f RenderFormat) ContentType() string {
+	return renderFormatContentTypes[f]
+}
+
+func (f RenderFormat) FileName(umlId int64) string {
+	return fmt.Sprintf("uml-%d.%s", umlId, renderFormatExtensions[f])
+}
+
+// UmlRendering is an output of the format which isn't stored in Uml, which the indexer renders on the first download.
+// The key is the format name whose parent is the Uml.
+type UmlRendering struct {
+	Ref       string    `datastore:"ref,noindex"`
+	CreatedAt time.Time `datastore:"createdAt,noindex"`
+}
+
+// indexerBaseUrl returns INDEXER_BASE_URL, or the URL of the indexer service of this app.
+func indexerBaseUrl(ctx context.Context) (string, error) {
+	if baseUrl := os.Getenv("INDEXER_BASE_URL"); baseUrl != "" {
+		return baseUrl, nil
+	}
+	hostname, err := appengine.ModuleHostname(ctx, INDEXER_SERVICE, "", "")
+	if err != nil {
+		return "", err
+	}
+	if appengine.IsDevAppServer() {
+		return "http://" + hostname, nil
+	}
+	return "https://" + hostname, nil
+}
+
+// FetchRendering returns the output of the format. The formats other than SVG, PNG and ASCII are rendered
+// by the indexer with its renderer on the first request, and stored in the blob store.
+func FetchRendering(ctx context.Context, uml *Uml, format RenderFormat) ([]byte, error) {
+	switch format {
+	case FormatSvg:
+		return uml.OriginalSvg(ctx)
+	case FormatPng:
+		return uml.Png(ctx)
+	case FormatAscii:
+		return uml.AsciiText(ctx)
+	}
+
+	parentKey := datastore.NewKey(ctx, "Uml", "", uml.ID, nil)
+	key := datastore.NewKey(ctx, "UmlRendering", string(format), 0, parentKey)
+	var rendering UmlRendering
+	err := datastore.Get(ctx, key, &rendering)
+	if err == nil {
+		return fetchBlob(ctx, rendering.Ref)
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return requestRendering(ctx, uml.ID, format)
+}
+
+func requestRendering(ctx context.Context, umlId int64, format RenderFormat) ([]byte, error) {
+	baseUrl, err := indexerBaseUrl(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RENDERING_REQUEST_TIMEOUT)
+	defer cancel()
+	url := fmt.Sprintf("%s/umls/%d/renderings/%s", baseUrl, umlId, format)
+	resp, err := urlfetch.Client(ctx).Post(url, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to render %s: status=%d", format, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -15,6 +15,47 @@ $(document).ready(function() {
     }, 1000);
   });
 
+  var escapeHtml = function(text) {
+    return $('<div>').text(text).html();
+  };
+
+  var highlight = function(source, word) {
+    if (!word) {
+      return escapeHtml(source);
+    }
+    var pattern = new RegExp('(' + word.replace(/[.*+?^${}()|[\]\\]/g, '\\$&') + ')', 'i');
+    // matched words are at odd indexes
+    return source.split(pattern).map(function(part, i) {
+      return i % 2 === 1 ? '<mark>' + escapeHtml(part) + '</mark>' : escapeHtml(part);
+    }).join('');
+  };
+
+  // load the SVG and the source of the modal
+  var loadUmlContent = function(umlId, highlightWord) {
+    var modal = $('#uml__modal__' + umlId);
+    if (modal.data('loaded')) {
+      return;
+    }
+    modal.data('loaded', true);
+
+    $.getJSON('/umls/' + umlId + '/content').done(function(content) {
+      modal.find('.uml__modal__body__svg').html(content.svg);
+      modal.find('.uml__modal__body__source__header__copy').attr('data-clipboard-text', content.source);
+
+      var lineNumbers = $('<span class="uml__modal__body__source__content__line_numbers"></span>');
+      var lines = content.source.split('\n').length;
+      for (var i = 0; i < lines; i++) {
+        lineNumbers.append('<span></span>');
+      }
+      modal.find('.uml__modal__body__source__content')
+        .html(highlight(content.source, highlightWord))
+        .append(lineNumbers);
+    }).fail(function() {
+      // try again when it's opened next time
+      modal.data('loaded', false);
+    });
+  };
+
   // setup modal
   $('.uml').each(function(i, elem) {
     var umlId = elem.dataset.umlId;
@@ -23,6 +64,7 @@ $(document).ready(function() {
       autoopen: autoopen,
       opacity: 0.7,
       onopen: function() {
+        loadUmlContent(umlId, elem.dataset.umlHighlightWord);
         var originalPath = location.pathname + location.search;
         history.replaceState(originalPath, null, '/umls/' + umlId);
       },
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var (
+	// tags of a sanitized SVG, whose attribute values never contain ">"
+	svgTagPattern = regexp.MustCompile(`<[^>]*>`)
+	svgIdPattern  = regexp.MustCompile(`(\sid=")([^"]*")`)
+	// quotes in attribute values are escaped by the sanitizer
+	svgUrlRefPattern = regexp.MustCompile(`(url\((?:'|&quot;)?#)`)
+	svgHrefPattern   = regexp.MustCompile(`(\s(?:xlink:)?href="#)`)
+)
+
+// namespaceSvgIds prefixes IDs of the SVG and references to them, because PlantUML
+// uses the same IDs for filters and markers of different diagrams inlined in a page.
+// The SVG must be sanitized, so that texts are escaped.
+func namespaceSvgIds(svg string, umlId int64) string {
+	prefix := fmt.Sprintf("uml%d-", umlId)
+	return svgTagPattern.ReplaceAllStringFunc(svg, func(tag string) string {
+		tag = svgIdPattern.ReplaceAllString(tag, "${1}"+prefix+"${2}")
+		tag = svgUrlRefPattern.ReplaceAllString(tag, "${1}"+prefix)
+		return svgHrefPattern.ReplaceAllString(tag, "${1}"+prefix)
+	})
+}
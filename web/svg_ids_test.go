@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNamespaceSvgIds(t *testing.T) {
+	tests := []struct {
+		svg      string
+		expected string
+	}{
+		{
+			`<svg><defs><filter id="f1"/></defs></svg>`,
+			`<svg><defs><filter id="uml42-f1"/></defs></svg>`,
+		},
+		{
+			`<svg><rect filter="url(#f1)" marker-end="url('#m1')"/><rect style="fill: url(&quot;#g1&quot;); filter: url(#f1);"/></svg>`,
+			`<svg><rect filter="url(#uml42-f1)" marker-end="url('#uml42-m1')"/><rect style="fill: url(&quot;#uml42-g1&quot;); filter: url(#uml42-f1);"/></svg>`,
+		},
+		{
+			`<svg><use xlink:href="#s1"/><use href="#s2"/></svg>`,
+			`<svg><use xlink:href="#uml42-s1"/><use href="#uml42-s2"/></svg>`,
+		},
+		// texts, links to other documents and attributes which merely end with "id" are not references
+		{
+			`<svg><text x="1">id="f1" url(#f1) href="#f1"</text><a xlink:href="https://example.com/#f1"/><g data-id="f1" pid="f1"/></svg>`,
+			`<svg><text x="1">id="f1" url(#f1) href="#f1"</text><a xlink:href="https://example.com/#f1"/><g data-id="f1" pid="f1"/></svg>`,
+		},
+	}
+
+	for _, tt := range tests {
+		actual := namespaceSvgIds(tt.svg, 42)
+		if actual != tt.expected {
+			t.Errorf("not expected svg: got=%s, expected=%s", actual, tt.expected)
+		}
+	}
+}
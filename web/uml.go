@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
-	"encoding/xml"
+	"encoding/base64"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/yfuruyama/real-world-plantuml/blobstore"
+	"github.com/yfuruyama/real-world-plantuml/svgsanitizer"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
@@ -13,33 +18,168 @@ import (
 )
 
 type Uml struct {
-	ID            int64       `datastore:"-"`
-	GitHubUrl     string      `datastore:"gitHubUrl"`
-	Source        string      `datastore:"source,noindex"`
-	SourceSHA256  string      `datastore:"sourceSHA256"`
-	DiagramType   DiagramType `datastore:"diagramType"`
-	Svg           string      `datastore:"svg,noindex"`
-	SvgViewBox    string      `datastore:"-"`
-	PngBase64     string      `datastore:"pngBase64,noindex"`
-	Ascii         string      `datastore:"ascii,noindex"`
-	HighlightWord string      `datastore:"-"`
+	ID           int64       `datastore:"-"`
+	GitHubUrl    string      `datastore:"gitHubUrl"`
+	Source       string      `datastore:"source,noindex"`
+	SourceSHA256 string      `datastore:"sourceSHA256"`
+	EncodedId    string      `datastore:"encodedId,noindex"`
+	DiagramType  DiagramType `datastore:"diagramType"`
+	// SyntaxDiagramType is the type given by the syntax checker, such as "DESCRIPTION"
+	SyntaxDiagramType string `datastore:"syntaxDiagramType"`
+	// SvgRef is the optimized SVG for pages, and SvgOriginalRef is the rendered one for downloads
+	SvgRef          string `datastore:"svgRef,noindex"`
+	SvgOriginalRef  string `datastore:"svgOriginalRef,noindex"`
+	PngRef          string `datastore:"pngRef,noindex"`
+	AsciiRef        string `datastore:"asciiRef,noindex"`
+	SvgSize         int    `datastore:"svgSize,noindex"`
+	SvgOriginalSize int    `datastore:"svgOriginalSize,noindex"`
+	// RendererVersion is the PlantUML version which rendered the assets
+	RendererVersion string   `datastore:"rendererVersion"`
+	Tags            []string `datastore:"tags"`
+	HighlightWord   string   `datastore:"-"`
+	// Thumbnails are shown in the listing
+	Thumbnails []UmlThumbnail `datastore:"thumbnails"`
+	// Svg is loaded by LoadSvg for the modal, unless it's not migrated to the blob store yet
+	Svg       string `datastore:"svg,noindex"`
+	PngBase64 string `datastore:"pngBase64,noindex"`
+	Ascii     string `datastore:"ascii,noindex"`
+}
+
+// keep in sync with THUMBNAIL_SIZES of the indexer
+var ThumbnailSizes = []int{200, 400}
+
+type UmlThumbnail struct {
+	Size int    `datastore:"size,noindex"`
+	Ref  string `datastore:"ref,noindex"`
+}
+
+func (u *Uml) Png(ctx context.Context) ([]byte, error) {
+	if u.PngRef != "" {
+		return fetchBlob(ctx, u.PngRef)
+	}
+	return base64.StdEncoding.DecodeString(u.PngBase64)
+}
+
+// OriginalSvg returns the SVG before the optimization if any.
+func (u *Uml) OriginalSvg(ctx context.Context) ([]byte, error) {
+	if u.SvgOriginalRef == "" {
+		if err := u.LoadSvg(ctx); err != nil {
+			return nil, err
+		}
+		return []byte(u.Svg), nil
+	}
+	svg, err := fetchBlob(ctx, u.SvgOriginalRef)
+	if err != nil {
+		return nil, err
+	}
+	return svgsanitizer.Sanitize(svg)
+}
+
+func (u *Uml) AsciiText(ctx context.Context) ([]byte, error) {
+	if u.AsciiRef != "" {
+		return fetchBlob(ctx, u.AsciiRef)
+	}
+	return []byte(u.Ascii), nil
+}
+
+var (
+	sharedBlobStoreMu sync.Mutex
+	sharedBlobStore   blobstore.Store
+)
+
+// fetchBlob reads the blob by the store which is created on the first call and reused by every request.
+// The store is created with the background context, because the client must outlive the request.
+func fetchBlob(ctx context.Context, ref string) ([]byte, error) {
+	sharedBlobStoreMu.Lock()
+	if sharedBlobStore == nil {
+		blobs, err := blobstore.NewFromEnv(appengine.BackgroundContext())
+		if err != nil {
+			sharedBlobStoreMu.Unlock()
+			return nil, err
+		}
+		sharedBlobStore = blobs
+	}
+	blobs := sharedBlobStore
+	sharedBlobStoreMu.Unlock()
+
+	return blobs.Get(ctx, ref)
+}
+
+// LoadSvg fetches the SVG from the blob store unless it's inline, and makes it ready to be inlined.
+func (u *Uml) LoadSvg(ctx context.Context) error {
+	svg := []byte(u.Svg)
+	if u.SvgRef != "" {
+		var err error
+		if svg, err = fetchBlob(ctx, u.SvgRef); err != nil {
+			return err
+		}
+	}
+
+	sanitized, err := svgsanitizer.Sanitize(svg)
+	if err != nil {
+		return err
+	}
+	u.Svg = namespaceSvgIds(string(sanitized), u.ID)
+	return nil
 }
 
-type SvgXml struct {
-	ViewBox string `xml:"viewBox,attr"`
+// Thumbnail returns the ref of the smallest thumbnail which is as large as the size,
+// or the largest one. It's empty if the Uml doesn't have thumbnails yet.
+func (u *Uml) Thumbnail(size int) string {
+	var best *UmlThumbnail
+	for i := range u.Thumbnails {
+		thumbnail := &u.Thumbnails[i]
+		switch {
+		case best == nil:
+			best = thumbnail
+		case best.Size < size:
+			if thumbnail.Size > best.Size {
+				best = thumbnail
+			}
+		case thumbnail.Size >= size && thumbnail.Size < best.Size:
+			best = thumbnail
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Ref
 }
 
 type DiagramType string
 
 const (
-	TypeSequence  DiagramType = "sequence"
-	TypeUsecase   DiagramType = "usecase"
-	TypeClass     DiagramType = "class"
-	TypeActivity  DiagramType = "activity"
-	TypeComponent DiagramType = "component"
-	TypeState     DiagramType = "state"
+	TypeSequence   DiagramType = "sequence"
+	TypeUsecase    DiagramType = "usecase"
+	TypeClass      DiagramType = "class"
+	TypeActivity   DiagramType = "activity"
+	TypeComponent  DiagramType = "component"
+	TypeState      DiagramType = "state"
+	TypeObject     DiagramType = "object"
+	TypeDeployment DiagramType = "deployment"
+	TypeTiming     DiagramType = "timing"
+	TypeNetwork    DiagramType = "network"
+	TypeER         DiagramType = "er"
+	TypeArchimate  DiagramType = "archimate"
+	// TypeOther is what the indexer can't classify
+	TypeOther DiagramType = "__unknown__"
 )
 
+// DiagramTypes are the categories of the nav, in the order shown
+var DiagramTypes = []DiagramType{
+	TypeSequence, TypeUsecase, TypeClass, TypeActivity, TypeComponent, TypeState,
+	TypeObject, TypeDeployment, TypeTiming, TypeNetwork, TypeER, TypeArchimate, TypeOther,
+}
+
+func (d DiagramType) IsValid() bool {
+	for _, typ := range DiagramTypes {
+		if typ == d {
+			return true
+		}
+	}
+	return false
+}
+
 func (d DiagramType) ToHumanString() string {
 	switch d {
 	case TypeSequence:
@@ -54,6 +194,20 @@ func (d DiagramType) ToHumanString() string {
 		return "Component"
 	case TypeState:
 		return "State"
+	case TypeObject:
+		return "Object"
+	case TypeDeployment:
+		return "Deployment"
+	case TypeTiming:
+		return "Timing"
+	case TypeNetwork:
+		return "Network"
+	case TypeER:
+		return "ER"
+	case TypeArchimate:
+		return "ArchiMate"
+	case TypeOther:
+		return "Other"
 	}
 	return ""
 }
@@ -62,7 +216,7 @@ func FetchUmls(ctx context.Context, typ DiagramType, count int, cursor string) (
 	q := datastore.NewQuery("Uml").Limit(count).KeysOnly()
 
 	// Set filter
-	if typ == TypeSequence || typ == TypeUsecase || typ == TypeClass || typ == TypeActivity || typ == TypeComponent || typ == TypeState {
+	if typ.IsValid() {
 		q = q.Filter("diagramType =", typ)
 	}
 
@@ -106,6 +260,106 @@ func FetchUmls(ctx context.Context, typ DiagramType, count int, cursor string) (
 	return umls, nextCursor, nil
 }
 
+// UNRECORDED_SYNTAX_TYPE filters unknown umls to ones indexed before SyntaxDiagramType is recorded
+const UNRECORDED_SYNTAX_TYPE = "__unrecorded__"
+
+// FetchUnknownUmls returns umls of TypeOther for the admin, filtered by the type of the syntax checker if it's not empty.
+func FetchUnknownUmls(ctx context.Context, syntaxType string, count int, cursor string) ([]*Uml, string, error) {
+	q := datastore.NewQuery("Uml").Filter("diagramType =", TypeOther)
+	unrecorded := syntaxType == UNRECORDED_SYNTAX_TYPE
+	if unrecorded {
+		// entities without the property can't be queried, so they are filtered while scanning
+	} else if syntaxType != "" {
+		q = q.Filter("syntaxDiagramType =", syntaxType).Limit(count)
+	} else {
+		q = q.Limit(count)
+	}
+	if cursor != "" {
+		decoded, err := datastore.DecodeCursor(cursor)
+		if err == nil {
+			q = q.Start(decoded)
+		}
+	}
+
+	iter := q.Run(ctx)
+	var umls []*Uml
+	for len(umls) < count {
+		var uml Uml
+		key, err := iter.Next(&uml)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			log.Criticalf(ctx, "datastore fetch error: %v", err)
+			return nil, "", err
+		}
+		if unrecorded && uml.SyntaxDiagramType != "" {
+			continue
+		}
+		uml.ID = key.IntID()
+		umls = append(umls, &uml)
+	}
+
+	var nextCursor string
+	if len(umls) == count {
+		if dsCursor, err := iter.Cursor(); err == nil {
+			nextCursor = dsCursor.String()
+		}
+	}
+	return umls, nextCursor, nil
+}
+
+type SyntaxTypeCount struct {
+	SyntaxDiagramType string
+	Count             int
+}
+
+// Filter is the syntaxType of FetchUnknownUmls for the count.
+func (c SyntaxTypeCount) Filter() string {
+	if c.SyntaxDiagramType == "" {
+		return UNRECORDED_SYNTAX_TYPE
+	}
+	return c.SyntaxDiagramType
+}
+
+// CountUnknownUmls counts umls of TypeOther by the type of the syntax checker.
+// Umls indexed before it's recorded are counted as the empty type.
+func CountUnknownUmls(ctx context.Context) ([]SyntaxTypeCount, error) {
+	total, err := datastore.NewQuery("Uml").Filter("diagramType =", TypeOther).KeysOnly().Count(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// a projection query skips entities without the property
+	q := datastore.NewQuery("Uml").Filter("diagramType =", TypeOther).Project("syntaxDiagramType")
+	counts := make(map[string]int)
+	iter := q.Run(ctx)
+	for {
+		var uml Uml
+		_, err := iter.Next(&uml)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		counts[uml.SyntaxDiagramType]++
+		total--
+	}
+	if total > 0 {
+		counts[""] += total
+	}
+
+	var results []SyntaxTypeCount
+	for typ, count := range counts {
+		results = append(results, SyntaxTypeCount{typ, count})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Count > results[j].Count
+	})
+	return results, nil
+}
+
 func FetchUmlById(ctx context.Context, id int64) (*Uml, error) {
 	umls, err := fetchUmlsByIds(ctx, []int64{id})
 	if err != nil || len(umls) == 0 {
@@ -195,18 +449,8 @@ func fetchUmlsByIds(ctx context.Context, ids []int64) ([]*Uml, error) {
 	var foundUmls []*Uml
 	for i, notFound := range notFounds {
 		if !notFound {
-			uml := umls[i]
-			uml.ID = ids[i]
-
-			// Set viewBox
-			var svgXml SvgXml
-			err = xml.Unmarshal([]byte(uml.Svg), &svgXml)
-			if err != nil {
-				log.Criticalf(ctx, "svg parse error: %v", err)
-			}
-			uml.SvgViewBox = svgXml.ViewBox
-
-			foundUmls = append(foundUmls, uml)
+			umls[i].ID = ids[i]
+			foundUmls = append(foundUmls, umls[i])
 		}
 	}
 